@@ -31,3 +31,83 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return "error offset out of range"
 }
+
+type ErrCorruptRecord struct {
+	Offset uint64
+}
+
+func (e ErrCorruptRecord) GRPCStatus() *status.Status {
+	st := status.New(codes.DataLoss, fmt.Sprintf("corrupt record at offset: %d", e.Offset))
+	userFriendlyMessage := fmt.Sprintf(
+		"The record at offset %d failed its integrity check",
+		e.Offset,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-SG",
+		Message: userFriendlyMessage,
+	}
+	statusWithDetails, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return statusWithDetails
+}
+
+func (e ErrCorruptRecord) Error() string {
+	return "error corrupt record"
+}
+
+type ErrOffsetTruncated struct {
+	Offset       uint64
+	LowestOffset uint64
+}
+
+func (e ErrOffsetTruncated) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.OutOfRange,
+		fmt.Sprintf("offset truncated: %d, lowest offset: %d", e.Offset, e.LowestOffset),
+	)
+	userFriendlyMessage := fmt.Sprintf(
+		"The requested offset %d has been removed from the log, the earliest record is at offset %d",
+		e.Offset,
+		e.LowestOffset,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-SG",
+		Message: userFriendlyMessage,
+	}
+	statusWithDetails, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return statusWithDetails
+}
+
+func (e ErrOffsetTruncated) Error() string {
+	return "error offset truncated"
+}
+
+type ErrOffsetCompacted struct {
+	Offset uint64
+}
+
+func (e ErrOffsetCompacted) GRPCStatus() *status.Status {
+	st := status.New(codes.NotFound, fmt.Sprintf("offset compacted: %d", e.Offset))
+	userFriendlyMessage := fmt.Sprintf(
+		"The record at offset %d was removed by compaction as a later record has the same key",
+		e.Offset,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-SG",
+		Message: userFriendlyMessage,
+	}
+	statusWithDetails, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return statusWithDetails
+}
+
+func (e ErrOffsetCompacted) Error() string {
+	return "error offset compacted"
+}
@@ -0,0 +1,59 @@
+// Command rekey rewrites the sealed segments of a log so that every record in them
+// is encrypted with the active key of a key file. Records keep their offsets.
+// The log must not be open in another process while it runs.
+//
+// The segment flags must be the settings the log is opened with, as the sealed segments are opened with them,
+// and the rewritten segments are compressed and indexed as they say.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/jxofficial/log/internal/log"
+)
+
+func main() {
+	dir := flag.String("dir", "", "directory of the log")
+	keyFile := flag.String("keyfile", "", "key file to encrypt the records with, its last key is the active key")
+	c := log.Config{}
+	flag.Uint64Var(&c.Segment.MaxStoreBytes, "max-store-bytes", 0, "maximum size of a segment's store, zero for the default")
+	flag.Uint64Var(&c.Segment.MaxIndexBytes, "max-index-bytes", 0, "maximum size of a segment's index, zero for the default")
+	flag.Uint64Var(&c.Segment.IndexIntervalBytes, "index-interval-bytes", 0, "store bytes between sparse index entries, zero indexes every record")
+	flag.Uint64Var(&c.Segment.TimeIndexIntervalBytes, "time-index-interval-bytes", 0, "store bytes between time index entries, zero for the default")
+	compression := flag.String("compression", "none", "codec to compress the records with: none, gzip, snappy or zstd")
+	flag.Parse()
+	codec, ok := codecs[*compression]
+	if *dir == "" || *keyFile == "" || !ok {
+		flag.Usage()
+		os.Exit(2)
+	}
+	c.Segment.Compression = codec
+	c.Encryption.KeyFile = *keyFile
+	if err := rekey(*dir, c); err != nil {
+		fmt.Fprintln(os.Stderr, "rekey:", err)
+		os.Exit(1)
+	}
+}
+
+// codecs are the codecs of the -compression flag by name.
+var codecs = map[string]log.Compression{
+	"none":   log.CompressionNone,
+	"gzip":   log.CompressionGzip,
+	"snappy": log.CompressionSnappy,
+	"zstd":   log.CompressionZstd,
+}
+
+// rekey opens the log in `dir` with `c`, and rekeys it.
+func rekey(dir string, c log.Config) error {
+	l, err := log.NewLog(dir, c)
+	if err != nil {
+		return err
+	}
+	if err = l.Rekey(); err != nil {
+		l.Close()
+		return err
+	}
+	return l.Close()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	api "github.com/jxofficial/log/api/v1"
+	"github.com/jxofficial/log/internal/log"
+)
+
+const (
+	key1 = "1 000102030405060708090a0b0c0d0e0f"
+	key2 = "2 101112131415161718191a1b1c1d1e1f101112131415161718191a1b1c1d1e1f"
+)
+
+func TestRekey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keyFile := path.Join(dir, "keys")
+	logDir := path.Join(dir, "log")
+	require.NoError(t, os.Mkdir(logDir, 0755))
+
+	// Each segment holds 100 records, more than the default MaxIndexBytes allows, and compresses them.
+	// The log has two sealed segments, and an empty active segment.
+	c := log.Config{}
+	c.Segment.MaxIndexBytes = 100 * 12
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.Compression = log.CompressionSnappy
+	c.Encryption.KeyFile = keyFile
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte(key1+"\n"), 0600))
+	l, err := log.NewLog(logDir, c)
+	require.NoError(t, err)
+	for i := 0; i < 200; i++ {
+		value := fmt.Sprintf(`{"id": %d, "name": "record", "tags": ["log", "record", "log", "record"]}`, i)
+		_, err := l.Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	// The segments cannot be opened with the default settings, and are left as they are.
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte(key1+"\n"+key2+"\n"), 0600))
+	defaults := log.Config{}
+	defaults.Encryption.KeyFile = keyFile
+	require.Error(t, rekey(logDir, defaults))
+
+	require.NoError(t, rekey(logDir, c))
+
+	// The log no longer needs the old key, and its segments are still compressed.
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte(key2+"\n"), 0600))
+	l, err = log.NewLog(logDir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for off := uint64(0); off < 200; off++ {
+		read, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+	}
+	sections, err := l.RawSections(0)
+	require.NoError(t, err)
+	require.Len(t, sections, 2)
+	for _, section := range sections {
+		b := make([]byte, 1)
+		_, err := section.Reader().Read(b)
+		require.NoError(t, err)
+		// The first byte of a raw entry holds its attributes, whose lowest three bits are its codec.
+		require.Equal(t, log.CompressionSnappy, log.Compression(b[0]&0x07))
+		require.NoError(t, section.Close())
+	}
+}
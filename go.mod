@@ -5,6 +5,7 @@ go 1.18
 require (
 	github.com/casbin/casbin v1.9.1
 	github.com/golang/protobuf v1.5.2
+	github.com/klauspost/compress v1.15.4
 	github.com/stretchr/testify v1.7.1
 	github.com/tysonmote/gommap v0.0.1
 	google.golang.org/genproto v0.0.0-20220505152158-f39f71e6c8f3
@@ -0,0 +1,112 @@
+package log
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/protobuf/proto"
+
+	api "github.com/jxofficial/log/api/v1"
+)
+
+// CacheStats describes the use of the log's record cache, see Config.Cache.
+type CacheStats struct {
+	// Hits is the number of reads served from the cache, and Misses the number of reads from the segments.
+	Hits   uint64
+	Misses uint64
+	// Records is the number of records in the cache, and Bytes their total marshalled size.
+	Records int
+	Bytes   uint64
+}
+
+// recordCache holds the most recently appended or read records, up to maxBytes of marshalled records.
+// The least recently used records are evicted first. It is safe for concurrent use.
+type recordCache struct {
+	maxBytes uint64
+	hits     uint64
+	misses   uint64
+
+	mu      sync.Mutex
+	size    uint64
+	lru     *list.List
+	entries map[uint64]*list.Element
+}
+
+type cacheEntry struct {
+	record *api.Record
+	size   uint64
+}
+
+func newRecordCache(maxBytes uint64) *recordCache {
+	return &recordCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[uint64]*list.Element),
+	}
+}
+
+// get returns a copy of the cached record at the offset, or nil if it is not cached.
+func (c *recordCache) get(off uint64) *api.Record {
+	c.mu.Lock()
+	e, ok := c.entries[off]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil
+	}
+	atomic.AddUint64(&c.hits, 1)
+	// The caller may modify the record, so the cached record is not handed out.
+	return proto.Clone(e.Value.(*cacheEntry).record).(*api.Record)
+}
+
+// put caches the record, which must not be modified afterwards, evicting the least recently used records
+// to make room for it. Records larger than the cache are not cached.
+func (c *recordCache) put(record *api.Record) {
+	size := uint64(proto.Size(record))
+	if size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[record.Offset]; ok {
+		c.evict(e)
+	}
+	for c.size+size > c.maxBytes {
+		c.evict(c.lru.Back())
+	}
+	c.entries[record.Offset] = c.lru.PushFront(&cacheEntry{record: record, size: size})
+	c.size += size
+}
+
+// remove evicts the cached records whose offsets are in [from, to).
+func (c *recordCache) remove(from, to uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for off, e := range c.entries {
+		if off >= from && off < to {
+			c.evict(e)
+		}
+	}
+}
+
+// evict removes the entry from the cache. The caller must hold the cache's lock.
+func (c *recordCache) evict(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	delete(c.entries, entry.record.Offset)
+	c.size -= entry.size
+}
+
+func (c *recordCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:    atomic.LoadUint64(&c.hits),
+		Misses:  atomic.LoadUint64(&c.misses),
+		Records: len(c.entries),
+		Bytes:   c.size,
+	}
+}
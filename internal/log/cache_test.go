@@ -0,0 +1,112 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	api "github.com/jxofficial/log/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordCache(t *testing.T) {
+	record := func(off uint64) *api.Record {
+		return &api.Record{Value: []byte("hello world"), Offset: off}
+	}
+	size := uint64(proto.Size(record(1)))
+	// The cache holds three records.
+	c := newRecordCache(3 * size)
+	for off := uint64(1); off <= 3; off++ {
+		c.put(record(off))
+	}
+	// Reading record 1 makes record 2 the least recently used, so it is evicted for record 4.
+	require.Equal(t, uint64(1), c.get(1).Offset)
+	c.put(record(4))
+	require.Nil(t, c.get(2))
+	for _, off := range []uint64{1, 3, 4} {
+		require.Equal(t, off, c.get(off).Offset)
+	}
+
+	// The cached records are copied, so modifying a read record does not modify the cache.
+	c.get(1).Value = []byte("modified")
+	require.Equal(t, "hello world", string(c.get(1).Value))
+
+	c.remove(3, 5)
+	require.Nil(t, c.get(3))
+	require.Equal(t, CacheStats{Hits: 6, Misses: 2, Records: 1, Bytes: size}, c.stats())
+
+	// A record larger than the cache is not cached.
+	c.put(&api.Record{Value: make([]byte, 3*size), Offset: 5})
+	require.Nil(t, c.get(5))
+	require.Equal(t, uint64(1), c.get(1).Offset)
+}
+
+func TestLogCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log_cache_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	// Each segment holds three records.
+	c.Segment.MaxIndexBytes = 3 * indexLenNumBytes
+	c.Cache.MaxBytes = 1 << 20
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	// Compaction keeps records 5, 6 and 7, the latest records of keys c, a and b.
+	for i := 0; i < 8; i++ {
+		key := []byte{'a' + byte(i%2)}
+		if i == 5 {
+			key = []byte("c")
+		}
+		_, err := log.Append(&api.Record{Key: key, Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	// Appended records are read from the cache.
+	for off := uint64(0); off < 8; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", off), string(read.Value))
+	}
+	require.Equal(t, uint64(8), log.CacheStats().Hits)
+	require.Equal(t, uint64(0), log.CacheStats().Misses)
+
+	// Compaction removes the records it removed from the segments from the cache too.
+	require.NoError(t, log.Compact())
+	stats := log.CacheStats()
+	_, err = log.Read(1)
+	require.Equal(t, api.ErrOffsetCompacted{Offset: 1}, err)
+	// Records left by compaction are read from the segments once, and cached again.
+	for i := 0; i < 2; i++ {
+		read, err := log.Read(5)
+		require.NoError(t, err)
+		require.Equal(t, "record 5", string(read.Value))
+	}
+	require.Equal(t, stats.Hits+1, log.CacheStats().Hits)
+	require.Equal(t, stats.Misses+2, log.CacheStats().Misses)
+
+	// Truncated records are removed from the cache.
+	require.Equal(t, 3, log.CacheStats().Records)
+	require.NoError(t, log.Truncate(5))
+	require.Equal(t, 2, log.CacheStats().Records)
+	_, err = log.Read(5)
+	require.Equal(t, api.ErrOffsetTruncated{Offset: 5, LowestOffset: 6}, err)
+}
+
+func TestLogCacheDisabled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log_cache_disabled_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	_, err = log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, CacheStats{}, log.CacheStats())
+}
@@ -0,0 +1,223 @@
+package log
+
+import (
+	"os"
+	"path"
+	"time"
+
+	api "github.com/jxofficial/log/api/v1"
+)
+
+// rewriteDir is the directory in the log's directory where rewritten segments are written
+// before they replace the original segments.
+const rewriteDir = "rewrite"
+
+// Compact rewrites the sealed segments so that only the latest record of each key is kept.
+// Records without a key are always kept. A tombstone, i.e. a record with a key and an empty value,
+// is kept until its segment was last appended to more than `Compaction.TombstoneRetention` ago,
+// and is then removed along with the key.
+// Records keep their offsets, and reading the offset of a removed record returns api.ErrOffsetCompacted.
+// The active segment is never compacted, but its records supersede older records with the same keys.
+func (l *Log) Compact() (err error) {
+	l.rewriteMu.Lock()
+	defer l.rewriteMu.Unlock()
+
+	sealed, tail := l.sealedSegments()
+	defer func() {
+		if releaseErr := l.releaseSegments(sealed); err == nil {
+			err = releaseErr
+		}
+	}()
+	if len(sealed) == 0 {
+		return nil
+	}
+	latest, err := l.latestOffsets(sealed, tail)
+	if err != nil {
+		return err
+	}
+	dir, err := l.makeRewriteDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	for _, s := range sealed {
+		dropTombstones := now.Sub(s.lastWrite) > l.Compaction.TombstoneRetention
+		err = l.rewriteSegment(dir, s, false, func(record *api.Record) bool {
+			return len(record.Key) == 0 ||
+				(latest[string(record.Key)] == record.Offset && (len(record.Value) > 0 || !dropTombstones))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sealedSegments returns the segments before the active segment, and the active segment's base offset.
+// The segments are acquired, so that they stay readable if they are removed from the log in the meantime,
+// and must be released with releaseSegments.
+func (l *Log) sealedSegments() ([]*segment, uint64) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	sealed := append([]*segment(nil), l.segments[:len(l.segments)-1]...)
+	for _, s := range sealed {
+		s.acquire()
+	}
+	return sealed, l.activeSegment.baseOffset
+}
+
+// releaseSegments releases the segments returned by sealedSegments.
+func (l *Log) releaseSegments(segments []*segment) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var err error
+	for _, s := range segments {
+		if releaseErr := s.release(); err == nil {
+			err = releaseErr
+		}
+	}
+	return err
+}
+
+// makeRewriteDir creates an empty directory to write rewritten segments to.
+func (l *Log) makeRewriteDir() (string, error) {
+	dir := path.Join(l.Dir, rewriteDir)
+	// Remove what is left over from a rewrite which was interrupted by a crash.
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	return dir, os.Mkdir(dir, 0755)
+}
+
+// latestOffsets returns the offset of the latest record of each key,
+// in the sealed segments and the records from offset `tail` onwards.
+// Sealed segments are not appended to, so they are read without holding the lock.
+func (l *Log) latestOffsets(sealed []*segment, tail uint64) (map[string]uint64, error) {
+	latest := make(map[string]uint64)
+	add := func(record *api.Record) error {
+		if len(record.Key) > 0 {
+			latest[string(record.Key)] = record.Offset
+		}
+		return nil
+	}
+	for _, s := range sealed {
+		if err := s.Records(add); err != nil {
+			return nil, err
+		}
+	}
+	for off := tail; ; off++ {
+		record, err := l.Read(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			return latest, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		_ = add(record)
+	}
+}
+
+// rewriteSegment writes the segment's records for which keep returns true to a new segment in `dir`,
+// compressed and encrypted as currently configured, and replaces the segment with it.
+// Unless `always` is true, the segment is left as is if every record is kept.
+func (l *Log) rewriteSegment(dir string, s *segment, always bool, keep func(*api.Record) bool) error {
+	rewritten, err := newSegment(dir, s.baseOffset, l.Config)
+	if err != nil {
+		return err
+	}
+	removed := false
+	// The kept records of each store entry are written together, so that a batch compressed together stays so.
+	err = s.Entries(func(records []*api.Record) error {
+		var kept []*api.Record
+		for _, record := range records {
+			if keep(record) {
+				kept = append(kept, record)
+			} else {
+				removed = true
+			}
+		}
+		if len(kept) == 0 {
+			return nil
+		}
+		return rewritten.AppendBatchAt(kept)
+	})
+	replace := always || removed
+	if err == nil && replace {
+		err = rewritten.Sync()
+	}
+	if closeErr := rewritten.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || !replace {
+		return err
+	}
+	// The next segment no longer starts right after the segment's last record if it was removed.
+	if removed || s.compacted {
+		if err = setFileHeaderFlags(rewritten.store.Name(), flagCompacted); err != nil {
+			return err
+		}
+	}
+	// Keep the segment's age, so that rewriting it does not delay its removal by the retention policy.
+	if err = os.Chtimes(rewritten.store.Name(), time.Now(), s.lastWrite); err != nil {
+		return err
+	}
+	return l.replaceSegment(s, rewritten.store.Name(), rewritten.index.Name(), rewritten.timeIndex.Name())
+}
+
+// replaceSegment replaces the sealed segment's files with the store, index and time index files
+// at the specified paths. Nothing is replaced if the segment has been removed from the log in the meantime.
+func (l *Log) replaceSegment(s *segment, storePath, indexPath, timeIndexPath string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := 0
+	for i < len(l.segments) && l.segments[i] != s {
+		i++
+	}
+	if i == len(l.segments) {
+		return nil
+	}
+	// The old files are replaced while the segment is open, as iterators may still be reading it.
+	// They keep reading the old files, which are closed once the segment is released.
+	// The old indexes are removed first: if the process crashes before the new indexes are in place,
+	// they are rebuilt from whichever store is in place when the segment is opened.
+	err := os.Remove(s.index.Name())
+	if err == nil {
+		err = os.Remove(s.timeIndex.Name())
+	}
+	if err == nil {
+		err = os.Rename(storePath, s.store.Name())
+	}
+	if err == nil {
+		err = os.Rename(indexPath, s.index.Name())
+	}
+	if err == nil {
+		err = os.Rename(timeIndexPath, s.timeIndex.Name())
+	}
+	if err != nil {
+		// Some of the old files may still be in place, and must be closed before they are opened again.
+		s.Close()
+	}
+	// The records removed from the segment must no longer be read.
+	if l.cache != nil {
+		l.cache.remove(s.baseOffset, s.nextOffset)
+	}
+	// Reopen the segment even if the files could not be replaced, so that the log can still read it.
+	reopened, openErr := newSegment(l.Dir, s.baseOffset, l.Config)
+	if openErr != nil {
+		if err == nil {
+			err = openErr
+		}
+		return err
+	}
+	// The segment was sealed before it was rewritten, as only sealed segments are rewritten.
+	if sealErr := reopened.store.seal(); err == nil {
+		err = sealErr
+	}
+	l.segments[i] = reopened
+	if releaseErr := s.release(); err == nil {
+		err = releaseErr
+	}
+	return err
+}
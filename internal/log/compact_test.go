@@ -0,0 +1,216 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/jxofficial/log/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompact(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, log *Log){
+		"superseded records are removed and offsets are kept": testCompactLatest,
+		"compacted segments survive reopening the log":        testCompactReopen,
+		"tombstones are removed after their retention":        testCompactTombstones,
+		"segments truncated while compacted stay readable":    testCompactTruncated,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "compact_test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			log := newCompactLog(t, dir, Config{})
+			defer log.Close()
+			fn(t, log)
+		})
+	}
+}
+
+func TestCompactBackground(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compact_background_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Compaction.Interval = 10 * time.Millisecond
+	log := newCompactLog(t, dir, c)
+	defer log.Close()
+	require.Eventually(t, func() bool {
+		_, err := log.Read(1)
+		return err == api.ErrOffsetCompacted{Offset: 1}
+	}, time.Second, 10*time.Millisecond)
+}
+
+// newCompactLog creates a log in `dir` holding the segments [0, 3), [3, 6) and the active segment from offset 6,
+// whose records supersede each other's keys.
+func newCompactLog(t *testing.T, dir string, c Config) *Log {
+	t.Helper()
+	// Each segment holds three records.
+	c.Segment.MaxIndexBytes = 3 * indexLenNumBytes
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for _, r := range []*api.Record{
+		{Value: []byte("no key")},
+		{Key: []byte("a"), Value: []byte("a1")},
+		{Key: []byte("b"), Value: []byte("b1")},
+		{Key: []byte("a"), Value: []byte("a2")},
+		{Key: []byte("b")},
+		{Key: []byte("c"), Value: []byte("c1")},
+		{Key: []byte("a"), Value: []byte("a3")},
+	} {
+		_, err := log.Append(r)
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 3)
+	return log
+}
+
+// requireCompacted checks that only the records at the `kept` offsets can be read from offsets 0 to 6.
+func requireCompacted(t *testing.T, log *Log, kept ...uint64) {
+	t.Helper()
+	for off := uint64(0); off < 7; off++ {
+		record, err := log.Read(off)
+		if !containsOffset(kept, off) {
+			require.Equal(t, api.ErrOffsetCompacted{Offset: off}, err, "offset %d", off)
+			continue
+		}
+		require.NoError(t, err, "offset %d", off)
+		require.Equal(t, off, record.Offset)
+	}
+}
+
+func containsOffset(offs []uint64, off uint64) bool {
+	for _, o := range offs {
+		if o == off {
+			return true
+		}
+	}
+	return false
+}
+
+func testCompactLatest(t *testing.T, log *Log) {
+	require.NoError(t, log.Compact())
+	// Offsets 1 and 2 at the end of the first segment and offset 3 were superseded.
+	// The tombstone of "b" is kept until its retention has passed.
+	requireCompacted(t, log, 0, 4, 5, 6)
+	record, err := log.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), record.Key)
+	require.Empty(t, record.Value)
+
+	// Appends continue after the highest offset, and seal the segment from offset 6.
+	for _, want := range []uint64{7, 8} {
+		off, err := log.Append(&api.Record{Key: []byte("a"), Value: []byte("a4")})
+		require.NoError(t, err)
+		require.Equal(t, want, off)
+	}
+	require.NoError(t, log.Compact())
+	requireCompacted(t, log, 0, 4, 5)
+	_, err = log.Read(7)
+	require.Equal(t, api.ErrOffsetCompacted{Offset: 7}, err)
+	record, err = log.Read(8)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a4"), record.Value)
+}
+
+func testCompactReopen(t *testing.T, log *Log) {
+	lastWrite := log.segments[0].lastWrite
+	require.NoError(t, log.Compact())
+	require.NoError(t, log.Close())
+
+	reopened, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer reopened.Close()
+	require.Nil(t, reopened.Repairs())
+	requireCompacted(t, reopened, 0, 4, 5, 6)
+	// Compaction does not change when a segment was last written.
+	require.WithinDuration(t, lastWrite, reopened.segments[0].lastWrite, time.Millisecond)
+	highest, err := reopened.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), highest)
+}
+
+func testCompactTombstones(t *testing.T, log *Log) {
+	log.segments[1].lastWrite = time.Now().Add(-2 * log.Compaction.TombstoneRetention)
+	require.NoError(t, log.Compact())
+	requireCompacted(t, log, 0, 5, 6)
+}
+
+func testCompactTruncated(t *testing.T, log *Log) {
+	sealed, tail := log.sealedSegments()
+	// Both sealed segments are removed while compaction is about to read them.
+	require.NoError(t, log.Truncate(5))
+	require.Len(t, log.segments, 1)
+	latest, err := log.latestOffsets(sealed, tail)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), latest["a"])
+	dir, err := log.makeRewriteDir()
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// The removed segment is not put back into the log.
+	require.NoError(t, log.rewriteSegment(dir, sealed[0], true, func(*api.Record) bool { return true }))
+	require.Len(t, log.segments, 1)
+	require.NoError(t, log.releaseSegments(sealed))
+	require.True(t, sealed[0].closed)
+}
+
+// appendBatches appends `n` batches of `size` records, where every fourth record has the key "k".
+func appendBatches(t *testing.T, log *Log, n, size int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		var batch []*api.Record
+		for j := 0; j < size; j++ {
+			record := &api.Record{Value: []byte(fmt.Sprintf(`{"batch":%d,"record":%d}`, i, j))}
+			if j%4 == 0 {
+				record.Key = []byte("k")
+			}
+			batch = append(batch, record)
+		}
+		_, err := log.AppendBatch(batch)
+		require.NoError(t, err)
+	}
+}
+
+func TestCompactBatchCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compact_batch_compression_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	// Each segment holds 40 batches of 20 records, compressed together.
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 40 * indexLenNumBytes
+	c.Segment.Compression = CompressionZstd
+	c.Segment.BatchCompression = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	appendBatches(t, log, 41, 20)
+	require.Len(t, log.segments, 2)
+
+	// The records kept from each batch are still compressed together, so they fit the segment's index.
+	require.NoError(t, log.Compact())
+	require.Equal(t, 40*indexLenNumBytes, log.segments[0].index.size)
+	for off := uint64(0); off < 800; off++ {
+		record, err := log.Read(off)
+		if off%4 == 0 {
+			require.Equal(t, api.ErrOffsetCompacted{Offset: off}, err, "offset %d", off)
+			continue
+		}
+		require.NoError(t, err, "offset %d", off)
+		require.Equal(t, off, record.Offset)
+	}
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Empty(t, log.Repairs())
+	record, err := log.Read(799)
+	require.NoError(t, err)
+	require.Equal(t, uint64(799), record.Offset)
+}
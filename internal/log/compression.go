@@ -0,0 +1,69 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the codec a store entry's record data is compressed with.
+// It is recorded in the attributes of each entry, so entries compressed with different codecs can be read.
+type Compression byte
+
+const (
+	// CompressionNone stores record data as is.
+	CompressionNone Compression = iota
+	// CompressionGzip compresses record data with gzip.
+	CompressionGzip
+	// CompressionSnappy compresses record data with snappy, which is fast but compresses less.
+	CompressionSnappy
+	// CompressionZstd compresses record data with zstd.
+	CompressionZstd
+)
+
+var (
+	// The zstd encoder and decoder are safe for concurrent use with EncodeAll and DecodeAll.
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// compress returns the record data compressed with the codec.
+func (c Compression) compress(p []byte) ([]byte, error) {
+	switch c {
+	case CompressionGzip:
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		if _, err := w.Write(p); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	case CompressionSnappy:
+		return snappy.Encode(nil, p), nil
+	case CompressionZstd:
+		return zstdEncoder.EncodeAll(p, nil), nil
+	}
+	return p, nil
+}
+
+// decompress returns the record data which was compressed with the codec.
+func (c Compression) decompress(p []byte) ([]byte, error) {
+	switch c {
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(p))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	case CompressionSnappy:
+		return snappy.Decode(nil, p)
+	case CompressionZstd:
+		return zstdDecoder.DecodeAll(p, nil)
+	}
+	return p, nil
+}
@@ -0,0 +1,176 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	api "github.com/jxofficial/log/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+var compressibleData = bytes.Repeat([]byte(`{"event":"page_view","path":"/index.html"},`), 20)
+
+func TestStoreCompression(t *testing.T) {
+	for _, codec := range []Compression{CompressionGzip, CompressionSnappy, CompressionZstd} {
+		f, err := ioutil.TempFile("", "store_compression_test")
+		require.NoError(t, err)
+		defer os.Remove(f.Name())
+
+		s, err := newStore(f)
+		require.NoError(t, err)
+		s.compression = codec
+		n, pos, err := s.Append(compressibleData)
+		require.NoError(t, err)
+		require.Less(t, n, uint64(len(compressibleData)), "codec %d", codec)
+		// Record data which does not get smaller is stored uncompressed.
+		_, rawPos, err := s.Append(recordData)
+		require.NoError(t, err)
+
+		for p, want := range map[uint64]struct {
+			data  []byte
+			codec Compression
+		}{
+			pos:    {compressibleData, codec},
+			rawPos: {recordData, CompressionNone},
+		} {
+			read, _, attrs, err := s.Entry(p)
+			require.NoError(t, err)
+			require.Equal(t, want.data, read)
+			require.Equal(t, want.codec, Compression(attrs&attrCompression))
+		}
+	}
+}
+
+func TestLogMixedCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log_mixed_compression_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Each time the log is opened, its records are compressed with a different codec.
+	var offsets []uint64
+	for _, codec := range []Compression{CompressionNone, CompressionGzip, CompressionSnappy, CompressionZstd} {
+		c := Config{}
+		c.Segment.Compression = codec
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+		off, err := log.AppendBatch([]*api.Record{{Value: compressibleData}, {Value: compressibleData}})
+		require.NoError(t, err)
+		offsets = append(offsets, off, off+1)
+		require.NoError(t, log.Close())
+	}
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	for _, off := range offsets {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, compressibleData, record.Value)
+	}
+
+	// A snapshot taken with the log's reader holds the codec of each entry.
+	snapshotDir, err := ioutil.TempDir("", "log_mixed_compression_snapshot_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(snapshotDir)
+	reader := log.Reader()
+	defer reader.Close()
+	b, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path.Join(snapshotDir, "0.store"), b, 0644))
+	snapshot, err := NewLog(snapshotDir, Config{})
+	require.NoError(t, err)
+	defer snapshot.Close()
+	for _, off := range offsets {
+		record, err := snapshot.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, compressibleData, record.Value)
+	}
+}
+
+func TestLogBatchCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log_batch_compression_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	batch := func() []*api.Record {
+		var records []*api.Record
+		for i := 0; i < 50; i++ {
+			value := fmt.Sprintf(`{"id":%d,"event":"page_view","path":"/index.html"}`, i)
+			records = append(records, &api.Record{Value: []byte(value)})
+		}
+		return records
+	}
+	// storeSize appends the batch to a new log, and returns the size of its store.
+	storeSize := func(name string, c Config) uint64 {
+		log, err := NewLog(path.Join(dir, name), c)
+		require.NoError(t, err)
+		defer log.Close()
+		_, err = log.AppendBatch(batch())
+		require.NoError(t, err)
+		return log.activeSegment.store.size
+	}
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 10
+	for _, name := range []string{"none", "record", "batch"} {
+		require.NoError(t, os.Mkdir(path.Join(dir, name), 0755))
+	}
+	uncompressed := storeSize("none", c)
+	c.Segment.Compression = CompressionZstd
+	perRecord := storeSize("record", c)
+	c.Segment.BatchCompression = true
+	batched := storeSize("batch", c)
+	// Each small record barely compresses on its own, but the batch does.
+	require.Less(t, batched, perRecord/2)
+	require.Less(t, batched, uncompressed/2)
+
+	log, err := NewLog(path.Join(dir, "batch"), c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Empty(t, log.Repairs())
+	// The batch has a single index entry.
+	require.Equal(t, indexLenNumBytes, log.activeSegment.index.size)
+	want := batch()
+	for i, record := range want {
+		read, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, record.Value, read.Value)
+	}
+	records, err := log.ReadRange(10, 5, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 5)
+	for i, record := range records {
+		require.Equal(t, uint64(10+i), record.Offset)
+	}
+
+	// A raw chunk holds the whole batch's entry, including the records before the requested offset.
+	b, next, err := log.ReadRaw(10, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(50), next)
+	records, err = DecodeRaw(b, nil)
+	require.NoError(t, err)
+	require.Len(t, records, 50)
+	require.Equal(t, uint64(0), records[0].Offset)
+
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(50), off)
+
+	// A torn record after the batch is dropped, and the log continues after the batch.
+	require.NoError(t, log.Close())
+	name := path.Join(dir, "batch", "0"+storeExt)
+	fi, err := os.Stat(name)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(name, fi.Size()-1))
+	log, err = NewLog(path.Join(dir, "batch"), c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Len(t, log.Repairs(), 1)
+	off, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(50), off)
+}
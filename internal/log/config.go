@@ -1,9 +1,89 @@
 package log
 
+import (
+	"time"
+)
+
 type Config struct {
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// IndexIntervalBytes makes the index sparse, with an entry at most once every IndexIntervalBytes of the store.
+		// Reads seek to the nearest preceding entry and scan the store forward from there.
+		// Zero indexes every record.
+		IndexIntervalBytes uint64
+		// Compression is the codec each record is compressed with when it is appended,
+		// including the records of a batch unless BatchCompression is set. Records which do not get smaller
+		// are stored uncompressed. Existing records keep the codec they were written with.
+		Compression Compression
+		// BatchCompression compresses the records of each batch appended with AppendBatch together,
+		// as a single store entry, rather than each record on its own. Small records with a similar structure,
+		// e.g. JSON, compress much better together. Reading any record of such a batch decodes the whole batch,
+		// and compaction and Rekey rewrite the records an entry each. It has no effect without Compression.
+		BatchCompression bool
+		// TimeIndexIntervalBytes is the minimum number of store bytes between entries in the time index.
+		// Defaults to 4096.
+		TimeIndexIntervalBytes uint64
+	}
+	// Durability controls when appended records are synced to disk.
+	Durability struct {
+		Mode SyncMode
+		// Records is the number of appends between syncs when Mode is SyncEveryN. Defaults to 100.
+		Records uint64
+		// Interval is the time between syncs when Mode is SyncInterval. Defaults to 1 second.
+		Interval time.Duration
+	}
+	// Retention controls when old segments are removed from the log.
+	// The active segment is never removed.
+	Retention struct {
+		// MaxAge is how long after its last append a segment is removed. Zero keeps segments forever.
+		MaxAge time.Duration
+		// MaxBytes is the total size of the segments' stores above which the oldest segments are removed.
+		// Zero does not limit the size of the log.
+		MaxBytes uint64
+		// CheckInterval is the time between checks for segments to remove. Defaults to 1 minute.
+		CheckInterval time.Duration
+		// OnRemove is called with every segment removed by the retention policy, e.g. to record metrics.
+		OnRemove func(RemovedSegment)
+	}
+	// Encryption controls the encryption of records at rest.
+	Encryption struct {
+		// KeyFile is the path of the key file to encrypt new records with, see LoadKeyring.
+		// Empty stores new records unencrypted. Encrypted records can only be read with their key in the key file.
+		KeyFile string
+		// keyring holds the keys loaded from KeyFile.
+		keyring *Keyring
+	}
+	// Cache controls the in-memory cache of recently appended and read records, which Log.Read serves records
+	// from without reading the segments.
+	Cache struct {
+		// MaxBytes is the total marshalled size of the cached records. Zero disables the cache.
+		MaxBytes uint64
+	}
+	// Compaction controls how sealed segments are compacted to the latest record of each key.
+	Compaction struct {
+		// Interval is the time between background compactions. Zero only compacts when Log.Compact is called.
+		Interval time.Duration
+		// TombstoneRetention is how long after its segment was last appended to a tombstone is kept,
+		// so that consumers see the deletion before it is removed. Defaults to 24 hours.
+		TombstoneRetention time.Duration
 	}
 }
+
+// SyncMode is the policy for syncing appended records to disk.
+type SyncMode int
+
+const (
+	// SyncOS buffers up to 4 KiB of appended records in memory, and hands them to the OS when the buffer
+	// fills up, or when the segment is rolled or closed. The OS decides when they reach disk.
+	// Buffered records are read from memory, so a process crash loses the records which are still buffered.
+	SyncOS SyncMode = iota
+	// SyncEveryAppend syncs every record to disk before Append returns.
+	SyncEveryAppend
+	// SyncEveryN syncs to disk once every `Durability.Records` appends,
+	// before the append which reaches the count returns.
+	SyncEveryN
+	// SyncInterval syncs to disk in the background once every `Durability.Interval`.
+	SyncInterval
+)
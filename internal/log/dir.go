@@ -0,0 +1,144 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	storeExt     = ".store"
+	indexExt     = ".index"
+	timeIndexExt = ".timeindex"
+)
+
+// DirError is returned by NewLog when the segments in the log's directory are inconsistent with each other
+// in a way which cannot be repaired, e.g. a segment holds records past the start of the next segment.
+type DirError struct {
+	Dir string
+	// Problems describes each inconsistency found.
+	Problems []string
+}
+
+func (e *DirError) Error() string {
+	return fmt.Sprintf("log directory %s is inconsistent: %s", e.Dir, strings.Join(e.Problems, "; "))
+}
+
+// segmentFiles holds the extensions of the files of a segment found in the log's directory.
+type segmentFiles struct {
+	baseOffset uint64
+	exts       map[string]bool
+}
+
+// scanDir returns the segments whose files are in `dir`, sorted by base offset.
+// Only files named `<offset>.store`, `<offset>.index` or `<offset>.timeindex` are segment files,
+// where the offset is written in decimal without leading zeros. Other files are ignored.
+func scanDir(dir string) ([]segmentFiles, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	byOffset := make(map[uint64]map[string]bool)
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		baseOffset, ext, ok := parseSegmentFileName(file.Name())
+		if !ok {
+			continue
+		}
+		if byOffset[baseOffset] == nil {
+			byOffset[baseOffset] = make(map[string]bool)
+		}
+		byOffset[baseOffset][ext] = true
+	}
+	segments := make([]segmentFiles, 0, len(byOffset))
+	for baseOffset, exts := range byOffset {
+		segments = append(segments, segmentFiles{baseOffset: baseOffset, exts: exts})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].baseOffset < segments[j].baseOffset
+	})
+	return segments, nil
+}
+
+// parseSegmentFileName returns the base offset and extension of a segment file's name,
+// e.g. 30.store is the store of the segment whose first record has offset 30.
+// It returns false if the name is not the name of a segment file.
+func parseSegmentFileName(name string) (uint64, string, bool) {
+	ext := path.Ext(name)
+	if ext != storeExt && ext != indexExt && ext != timeIndexExt {
+		return 0, "", false
+	}
+	offsetStr := strings.TrimSuffix(name, ext)
+	baseOffset, err := strconv.ParseUint(offsetStr, 10, 64)
+	if err != nil || strconv.FormatUint(baseOffset, 10) != offsetStr {
+		return 0, "", false
+	}
+	return baseOffset, ext, true
+}
+
+// removeOrphanIndexes removes the index files of a segment whose store is missing.
+// The store holds the records, so the indexes have nothing left to index.
+func removeOrphanIndexes(dir string, files segmentFiles) error {
+	for ext := range files.exts {
+		if err := os.Remove(path.Join(dir, fmt.Sprintf("%d%s", files.baseOffset, ext))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSegments returns the inconsistencies between the log's segments:
+// a segment holding records at or after the base offset of the next segment,
+// or offsets missing between a segment and the next one which cannot be explained by compaction or a repair.
+func (l *Log) checkSegments() []string {
+	var problems []string
+	for i := 1; i < len(l.segments); i++ {
+		prev, s := l.segments[i-1], l.segments[i]
+		switch {
+		case prev.nextOffset > s.baseOffset:
+			problems = append(problems, fmt.Sprintf("segment %d holds records up to offset %d, past the start of segment %d",
+				prev.baseOffset, prev.nextOffset-1, s.baseOffset))
+		case prev.nextOffset < s.baseOffset && !prev.compacted &&
+			(prev.repair == nil || prev.repair.TruncatedStoreBytes == 0):
+			problems = append(problems, fmt.Sprintf("offsets %d to %d are missing between segment %d and segment %d",
+				prev.nextOffset, s.baseOffset-1, prev.baseOffset, s.baseOffset))
+		}
+	}
+	return problems
+}
+
+// writeFileSync writes `b` to the file `name`, and syncs the file to disk.
+func writeFileSync(name string, b []byte) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncDir syncs the directory `dir` to disk, so that the files renamed into or removed from it stay that way
+// after a crash.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
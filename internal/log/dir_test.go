@@ -0,0 +1,128 @@
+package log
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	api "github.com/jxofficial/log/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogSetupDir(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string, c Config){
+		"files which are not segment files are ignored": testIgnoreStrayFiles,
+		"index files without a store are removed":       testRemoveOrphanIndexes,
+		"missing segment is refused":                    testRefuseGap,
+		"refused directory keeps its orphan indexes":    testRefuseGapKeepsOrphanIndexes,
+		"overlapping segments are refused":              testRefuseOverlap,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log_setup_dir_test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			// Each segment holds three records, so the log has segments 0, 3 and 6.
+			c := Config{}
+			c.Segment.MaxIndexBytes = 3 * indexLenNumBytes
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			appendRecords(t, log, 8)
+			require.NoError(t, log.Close())
+			fn(t, dir, c)
+		})
+	}
+}
+
+func appendRecords(t *testing.T, log *Log, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+}
+
+func testIgnoreStrayFiles(t *testing.T, dir string, c Config) {
+	for _, name := range []string{"README", "1.store.tmp", "01.store", "one.index", "2.log"} {
+		require.NoError(t, ioutil.WriteFile(path.Join(dir, name), []byte("stray"), 0644))
+	}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Len(t, log.segments, 3)
+	require.Empty(t, log.Repairs())
+	for _, name := range []string{"README", "1.store.tmp", "01.store", "one.index", "2.log"} {
+		_, err = os.Stat(path.Join(dir, name))
+		require.NoError(t, err)
+	}
+}
+
+func testRemoveOrphanIndexes(t *testing.T, dir string, c Config) {
+	// The store of segment 0 was deleted by hand, and its indexes were left behind.
+	require.NoError(t, os.Remove(path.Join(dir, "0.store")))
+	// A segment without an index rebuilds it.
+	require.NoError(t, os.Remove(path.Join(dir, "6.index")))
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Len(t, log.segments, 2)
+	require.Equal(t, []SegmentRepair{
+		{BaseOffset: 0, RemovedOrphanIndex: true},
+		{BaseOffset: 6, RecoveredIndexEntries: 2, RebuiltIndex: true},
+	}, log.Repairs())
+	for _, name := range []string{"0.index", "0.timeindex"} {
+		_, err = os.Stat(path.Join(dir, name))
+		require.True(t, os.IsNotExist(err))
+	}
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), lowest)
+}
+
+func testRefuseGap(t *testing.T, dir string, c Config) {
+	for _, ext := range []string{storeExt, indexExt, timeIndexExt} {
+		require.NoError(t, os.Remove(path.Join(dir, "3"+ext)))
+	}
+	_, err := NewLog(dir, c)
+	var dirErr *DirError
+	require.True(t, errors.As(err, &dirErr))
+	require.Equal(t, []string{"offsets 3 to 5 are missing between segment 0 and segment 6"}, dirErr.Problems)
+}
+
+func testRefuseGapKeepsOrphanIndexes(t *testing.T, dir string, c Config) {
+	require.NoError(t, os.Remove(path.Join(dir, "3"+storeExt)))
+	_, err := NewLog(dir, c)
+	var dirErr *DirError
+	require.True(t, errors.As(err, &dirErr))
+	for _, ext := range []string{indexExt, timeIndexExt} {
+		_, err = os.Stat(path.Join(dir, "3"+ext))
+		require.NoError(t, err)
+	}
+}
+
+func testRefuseOverlap(t *testing.T, dir string, c Config) {
+	// A segment starting at offset 1 is copied in from another log.
+	other, err := ioutil.TempDir("", "log_setup_dir_other_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(other)
+	c.Segment.InitialOffset = 1
+	log, err := NewLog(other, c)
+	require.NoError(t, err)
+	appendRecords(t, log, 3)
+	require.NoError(t, log.Close())
+	for _, ext := range []string{storeExt, indexExt, timeIndexExt} {
+		b, err := ioutil.ReadFile(path.Join(other, "1"+ext))
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(path.Join(dir, "1"+ext), b, 0644))
+	}
+
+	_, err = NewLog(dir, c)
+	var dirErr *DirError
+	require.True(t, errors.As(err, &dirErr))
+	require.Len(t, dirErr.Problems, 2)
+	require.True(t, strings.Contains(err.Error(), "segment 0 holds records up to offset 2, past the start of segment 1"))
+}
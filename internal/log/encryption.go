@@ -0,0 +1,129 @@
+package log
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	keyIDNumBytes = 4
+)
+
+var (
+	// errKeyNotFound is returned when a store entry is encrypted with a key which is not in the keyring.
+	errKeyNotFound = errors.New("encryption key not found")
+	// errDecrypt is returned when a store entry cannot be decrypted with its key.
+	// Entries are checksummed before they are decrypted, so this means the key is wrong rather than the entry corrupt.
+	errDecrypt = errors.New("cannot decrypt store entry")
+)
+
+// Keyring holds the AES keys store entries are encrypted with, by key ID.
+type Keyring struct {
+	aeads map[uint32]cipher.AEAD
+	// active is the ID of the key new entries are encrypted with.
+	active uint32
+}
+
+// LoadKeyring loads the keys in the key file at `path`.
+// Each line holds a numeric key ID and a hex-encoded AES key of 16, 24 or 32 bytes, separated by whitespace.
+// Blank lines and lines starting with # are ignored.
+// New entries are encrypted with the last key in the file, so keys are rotated by adding a new key at the end.
+// Older keys must be kept in the file until no entry is encrypted with them, see Log.Rekey.
+func LoadKeyring(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	k := &Keyring{aeads: make(map[uint32]cipher.AEAD)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("key file %s line %d: want a key ID and a key", path, line)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("key file %s line %d: invalid key ID: %w", path, line, err)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("key file %s line %d: invalid key: %w", path, line, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key file %s line %d: %w", path, line, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := k.aeads[uint32(id)]; ok {
+			return nil, fmt.Errorf("key file %s line %d: duplicate key ID %d", path, line, id)
+		}
+		k.aeads[uint32(id)] = aead
+		k.active = uint32(id)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(k.aeads) == 0 {
+		return nil, fmt.Errorf("key file %s has no keys", path)
+	}
+	return k, nil
+}
+
+// encrypt returns the record data encrypted with the active key.
+// The ID of the key and the nonce are written before the ciphertext.
+func (k *Keyring) encrypt(p []byte) ([]byte, error) {
+	aead := k.aeads[k.active]
+	b := make([]byte, keyIDNumBytes+aead.NonceSize(), keyIDNumBytes+aead.NonceSize()+len(p)+aead.Overhead())
+	enc.PutUint32(b, k.active)
+	if _, err := rand.Read(b[keyIDNumBytes:]); err != nil {
+		return nil, err
+	}
+	// The key ID is authenticated, so an entry cannot be made to be decrypted with another key.
+	return aead.Seal(b, b[keyIDNumBytes:], p, b[:keyIDNumBytes]), nil
+}
+
+// decrypt returns the record data of an encrypted entry.
+func (k *Keyring) decrypt(p []byte) ([]byte, error) {
+	id, err := entryKeyID(p)
+	if err != nil {
+		return nil, err
+	}
+	aead, ok := k.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: key ID %d", errKeyNotFound, id)
+	}
+	if len(p) < keyIDNumBytes+aead.NonceSize() {
+		return nil, errDecrypt
+	}
+	nonce := p[keyIDNumBytes : keyIDNumBytes+aead.NonceSize()]
+	b, err := aead.Open(nil, nonce, p[keyIDNumBytes+aead.NonceSize():], p[:keyIDNumBytes])
+	if err != nil {
+		return nil, fmt.Errorf("%w: key ID %d", errDecrypt, id)
+	}
+	return b, nil
+}
+
+// entryKeyID returns the ID of the key the encrypted entry data was encrypted with.
+func entryKeyID(p []byte) (uint32, error) {
+	if len(p) < keyIDNumBytes {
+		return 0, errDecrypt
+	}
+	return enc.Uint32(p), nil
+}
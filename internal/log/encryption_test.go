@@ -0,0 +1,185 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	api "github.com/jxofficial/log/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	key1 = "1 000102030405060708090a0b0c0d0e0f"
+	key2 = "2 101112131415161718191a1b1c1d1e1f101112131415161718191a1b1c1d1e1f"
+)
+
+func writeKeyFile(t *testing.T, dir string, lines ...string) string {
+	t.Helper()
+	p := path.Join(dir, "keys")
+	require.NoError(t, ioutil.WriteFile(p, []byte(strings.Join(lines, "\n")+"\n"), 0600))
+	return p
+}
+
+func TestLoadKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "load_keyring_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	k, err := LoadKeyring(writeKeyFile(t, dir, "# rotated monthly", key1, "", key2))
+	require.NoError(t, err)
+	require.Len(t, k.aeads, 2)
+	require.Equal(t, uint32(2), k.active)
+
+	for _, lines := range [][]string{
+		{"# no keys"},
+		{"1"},
+		{"one 000102030405060708090a0b0c0d0e0f"},
+		{"1 not-hex"},
+		{"1 0001020304"},
+		{key1, key1},
+	} {
+		_, err = LoadKeyring(writeKeyFile(t, dir, lines...))
+		require.Error(t, err, "%q", lines)
+	}
+}
+
+func TestStoreEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store_encryption_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	k, err := LoadKeyring(writeKeyFile(t, dir, key1))
+	require.NoError(t, err)
+
+	f, err := os.OpenFile(path.Join(dir, "0.store"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	s, err := newStore(f)
+	require.NoError(t, err)
+	s.keyring = k
+	s.compression = CompressionGzip
+	_, pos, err := s.Append(compressibleData)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	b, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(b, []byte("page_view")))
+
+	f, err = os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	s, err = newStore(f)
+	require.NoError(t, err)
+	defer s.Close()
+	// Without the key, the entry cannot be read, but it is not corrupt either.
+	_, _, _, err = s.Entry(pos)
+	require.True(t, errors.Is(err, errKeyNotFound))
+	s.keyring = k
+	read, _, attrs, err := s.Entry(pos)
+	require.NoError(t, err)
+	require.Equal(t, compressibleData, read)
+	require.Equal(t, CompressionGzip, Compression(attrs&attrCompression))
+	require.NotZero(t, attrs&attrEncrypted)
+}
+
+func TestLogEncryptionRekey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log_encryption_rekey_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keyDir, err := ioutil.TempDir("", "log_encryption_rekey_keys_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(keyDir)
+
+	open := func(keyLines ...string) (*Log, error) {
+		c := Config{}
+		c.Segment.MaxIndexBytes = 3 * indexLenNumBytes
+		c.Encryption.KeyFile = writeKeyFile(t, keyDir, keyLines...)
+		return NewLog(dir, c)
+	}
+	appendRecords := func(log *Log, n int) {
+		for i := 0; i < n; i++ {
+			_, err := log.Append(&api.Record{Value: recordData})
+			require.NoError(t, err)
+		}
+	}
+
+	// Rotating the key keeps the records encrypted with the old key readable.
+	log, err := open(key1)
+	require.NoError(t, err)
+	appendRecords(log, 4)
+	require.NoError(t, log.Close())
+	log, err = open(key1, key2)
+	require.NoError(t, err)
+	appendRecords(log, 4)
+	for off := uint64(0); off < 8; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, recordData, record.Value)
+	}
+	require.NoError(t, log.Close())
+
+	// A missing key fails opening the log instead of truncating the records it cannot read.
+	_, err = open(key2)
+	require.True(t, errors.Is(err, errKeyNotFound))
+
+	log, err = open(key1, key2)
+	require.NoError(t, err)
+	require.NoError(t, log.Rekey())
+	require.NoError(t, log.Close())
+
+	// Once the sealed segments are rekeyed, the old key is no longer needed for them.
+	log, err = open(key2)
+	require.NoError(t, err)
+	defer log.Close()
+	for off := uint64(0); off < 8; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+		require.Equal(t, recordData, record.Value)
+	}
+}
+
+func TestLogEncryptionRekeyBatchCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log_encryption_rekey_batch_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keyDir, err := ioutil.TempDir("", "log_encryption_rekey_batch_keys_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(keyDir)
+
+	open := func(keyLines ...string) (*Log, error) {
+		c := Config{}
+		// Each segment holds 40 batches of 20 records, compressed together.
+		c.Segment.MaxStoreBytes = 1 << 20
+		c.Segment.MaxIndexBytes = 40 * indexLenNumBytes
+		c.Segment.Compression = CompressionZstd
+		c.Segment.BatchCompression = true
+		c.Encryption.KeyFile = writeKeyFile(t, keyDir, keyLines...)
+		return NewLog(dir, c)
+	}
+	log, err := open(key1)
+	require.NoError(t, err)
+	// The active segment is empty, so that the old key is only needed for the sealed segment.
+	appendBatches(t, log, 40, 20)
+	require.Len(t, log.segments, 2)
+	require.NoError(t, log.Close())
+
+	log, err = open(key1, key2)
+	require.NoError(t, err)
+	require.NoError(t, log.Rekey())
+	// The rekeyed segment keeps its batches compressed together.
+	require.Equal(t, 40*indexLenNumBytes, log.segments[0].index.size)
+	require.NoError(t, log.Close())
+
+	log, err = open(key2)
+	require.NoError(t, err)
+	defer log.Close()
+	for off := uint64(0); off < 800; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+}
@@ -0,0 +1,209 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	// formatVersion is the version of the segment file format written by this version of the log.
+	// Version 1 is the first version with a file header. Files without a header are upgraded when they are opened.
+	formatVersion uint16 = 1
+
+	magicNumBytes      = 4
+	versionNumBytes    = 2
+	flagsNumBytes      = 2
+	baseOffsetNumBytes = 8
+	// fileHeaderNumBytes is the size of the header at the start of each segment file.
+	// Store positions and index entries are relative to the end of the header.
+	fileHeaderNumBytes uint64 = magicNumBytes + versionNumBytes + flagsNumBytes + baseOffsetNumBytes
+
+	// The magic numbers identify the kind of segment file.
+	// The first byte of a store's magic number has attribute bits no entry can have,
+	// so a store which starts with it cannot be a store without a header.
+	storeMagic     = "PLGS"
+	indexMagic     = "PLGI"
+	timeIndexMagic = "PLGT"
+
+	// flagCompacted marks a store whose segment may be missing records at its end, i.e. there may be a gap
+	// between its last record and the next segment, because records were removed from it by compaction.
+	// Stores upgraded from files without a header are marked too, as they may have been compacted.
+	flagCompacted uint16 = 0x1
+	// flagLegacyEntries marks a store upgraded from a file without a header, which may hold entries
+	// written before checksums were introduced. Only such stores may hold entries without attributes,
+	// so that an entry whose checksum attribute is cleared by corruption is not read unchecked elsewhere.
+	flagLegacyEntries uint16 = 0x2
+	// knownFlags are the flags this version of the log understands.
+	knownFlags = flagCompacted | flagLegacyEntries
+
+	// migrateSuffix is appended to the name of a segment file while it is upgraded.
+	migrateSuffix = ".migrate"
+)
+
+// ErrUnknownFormatVersion is returned when a segment file was written by a newer version of the log.
+var ErrUnknownFormatVersion = errors.New("unknown segment file format version")
+
+// fileHeader is the header at the start of each segment file, following the magic number.
+type fileHeader struct {
+	version    uint16
+	flags      uint16
+	baseOffset uint64
+}
+
+// readFileHeader reads the header of the file, and returns nil if the file does not start with `magic`.
+func readFileHeader(f *os.File, magic string) (*fileHeader, error) {
+	b := make([]byte, fileHeaderNumBytes)
+	if _, err := f.ReadAt(b, 0); err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if string(b[:magicNumBytes]) != magic {
+		return nil, nil
+	}
+	b = b[magicNumBytes:]
+	return &fileHeader{
+		version:    enc.Uint16(b),
+		flags:      enc.Uint16(b[versionNumBytes:]),
+		baseOffset: enc.Uint64(b[versionNumBytes+flagsNumBytes:]),
+	}, nil
+}
+
+// fileHeaderSize returns the size of the header of the file if it starts with one of the magic numbers, and 0 otherwise.
+func fileHeaderSize(f *os.File, magics ...string) (uint64, error) {
+	for _, magic := range magics {
+		h, err := readFileHeader(f, magic)
+		if err != nil {
+			return 0, err
+		}
+		if h != nil {
+			return fileHeaderNumBytes, nil
+		}
+	}
+	return 0, nil
+}
+
+// encodeFileHeader returns the header of a segment file of the current version.
+func encodeFileHeader(magic string, baseOffset uint64, flags uint16) []byte {
+	b := make([]byte, fileHeaderNumBytes)
+	copy(b, magic)
+	enc.PutUint16(b[magicNumBytes:], formatVersion)
+	enc.PutUint16(b[magicNumBytes+versionNumBytes:], flags)
+	enc.PutUint64(b[magicNumBytes+versionNumBytes+flagsNumBytes:], baseOffset)
+	return b
+}
+
+// openSegmentFile opens the segment file at `name`, creating it with a header if it does not exist.
+// A file without a header, written before headers were introduced, is upgraded by rewriting it with a header.
+// It returns an error if the header is of an unknown version, or is not for the segment at `baseOffset`.
+func openSegmentFile(name, magic string, baseOffset uint64, flag int) (*os.File, *fileHeader, error) {
+	// The copy is only renamed into place once it is complete,
+	// so a copy left behind by an upgrade interrupted by a crash is incomplete.
+	if err := os.Remove(name + migrateSuffix); err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	f, err := os.OpenFile(name, flag|os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if fi.Size() == 0 {
+		if _, err = f.Write(encodeFileHeader(magic, baseOffset, 0)); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return f, &fileHeader{version: formatVersion, baseOffset: baseOffset}, nil
+	}
+	h, err := readFileHeader(f, magic)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if h == nil {
+		f.Close()
+		h = &fileHeader{version: formatVersion, baseOffset: baseOffset}
+		if magic == storeMagic {
+			h.flags = flagCompacted | flagLegacyEntries
+		}
+		if err = migrateSegmentFile(name, magic, h); err != nil {
+			return nil, nil, err
+		}
+		f, err = os.OpenFile(name, flag|os.O_RDWR, 0644)
+		return f, h, err
+	}
+	switch {
+	case h.version > formatVersion:
+		err = fmt.Errorf("%s: %w %d, this version of the log reads up to version %d",
+			name, ErrUnknownFormatVersion, h.version, formatVersion)
+	case h.flags&^knownFlags != 0:
+		err = fmt.Errorf("%s: unknown flags %#x in version %d header", name, h.flags&^knownFlags, h.version)
+	case h.baseOffset != baseOffset:
+		err = fmt.Errorf("%s: header has base offset %d, but the file name has %d", name, h.baseOffset, baseOffset)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, h, nil
+}
+
+// setFileHeaderFlags sets the flags in the header of the segment file at `name`.
+func setFileHeaderFlags(name string, flags uint16) error {
+	f, err := os.OpenFile(name, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, flagsNumBytes)
+	enc.PutUint16(b, flags)
+	_, err = f.WriteAt(b, magicNumBytes+versionNumBytes)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// migrateSegmentFile upgrades a segment file without a header by writing a copy of it with a header,
+// which replaces the file once it is synced to disk.
+func migrateSegmentFile(name, magic string, h *fileHeader) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(name+migrateSuffix, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(encodeFileHeader(magic, h.baseOffset, h.flags))
+	if err == nil {
+		_, err = io.Copy(dst, src)
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return err
+	}
+	// Keep the file's age, so that upgrading it does not delay its removal by the retention policy.
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if err = os.Chtimes(dst.Name(), fi.ModTime(), fi.ModTime()); err != nil {
+		return err
+	}
+	return os.Rename(dst.Name(), name)
+}
@@ -0,0 +1,106 @@
+package log
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	api "github.com/jxofficial/log/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+var segmentFileMagics = map[string]string{
+	"16.store":     storeMagic,
+	"16.index":     indexMagic,
+	"16.timeindex": timeIndexMagic,
+}
+
+func TestSegmentFileHeader(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string, c Config){
+		"new segment files have a header":             testNewSegmentHeader,
+		"segment files without a header are upgraded": testMigrateSegment,
+		"unknown version is rejected":                 testUnknownVersion,
+		"header of another segment is rejected":       testWrongBaseOffset,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "segment_file_header_test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			c.Segment.MaxIndexBytes = 1024
+			c.Segment.TimeIndexIntervalBytes = 1
+			s := crashedSegment(t, dir, c, 3)
+			require.NoError(t, s.Close())
+			fn(t, dir, c)
+		})
+	}
+}
+
+func testNewSegmentHeader(t *testing.T, dir string, c Config) {
+	for name, magic := range segmentFileMagics {
+		b, err := ioutil.ReadFile(path.Join(dir, name))
+		require.NoError(t, err)
+		require.Equal(t, encodeFileHeader(magic, 16, 0), b[:fileHeaderNumBytes], name)
+	}
+}
+
+func testMigrateSegment(t *testing.T, dir string, c Config) {
+	// Strip the headers, leaving the files as they were written before headers were introduced.
+	for name := range segmentFileMagics {
+		b, err := ioutil.ReadFile(path.Join(dir, name))
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(path.Join(dir, name), b[fileHeaderNumBytes:], 0644))
+	}
+	// A leftover copy of an upgrade interrupted by a crash is discarded.
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "16.store"+migrateSuffix), []byte("PLGS"), 0644))
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Nil(t, s.repair)
+	// The segment may have been compacted before it was upgraded.
+	require.True(t, s.compacted)
+	// The store may hold entries written before checksums were introduced.
+	require.True(t, s.store.legacy)
+	requireReadable(t, s, 3)
+	appendRecord(t, s, &api.Record{Value: []byte("hello world")})
+	require.NoError(t, s.Close())
+
+	for name, magic := range segmentFileMagics {
+		b, err := ioutil.ReadFile(path.Join(dir, name))
+		require.NoError(t, err)
+		flags := uint16(0)
+		if magic == storeMagic {
+			flags = flagCompacted | flagLegacyEntries
+		}
+		require.Equal(t, encodeFileHeader(magic, 16, flags), b[:fileHeaderNumBytes], name)
+	}
+	_, err = os.Stat(path.Join(dir, "16.store"+migrateSuffix))
+	require.True(t, os.IsNotExist(err))
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Nil(t, s.repair)
+	requireReadable(t, s, 4)
+}
+
+func testUnknownVersion(t *testing.T, dir string, c Config) {
+	f, err := os.OpenFile(path.Join(dir, "16.store"), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	b := make([]byte, versionNumBytes)
+	enc.PutUint16(b, formatVersion+1)
+	_, err = f.WriteAt(b, magicNumBytes)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = newSegment(dir, 16, c)
+	require.True(t, errors.Is(err, ErrUnknownFormatVersion))
+}
+
+func testWrongBaseOffset(t *testing.T, dir string, c Config) {
+	require.NoError(t, os.Rename(path.Join(dir, "16.store"), path.Join(dir, "17.store")))
+	_, err := newSegment(dir, 17, c)
+	require.Error(t, err)
+}
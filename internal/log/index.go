@@ -1,8 +1,10 @@
 package log
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"sort"
 
 	"github.com/tysonmote/gommap"
 )
@@ -16,42 +18,75 @@ const (
 type index struct {
 	file *os.File
 	mmap gommap.MMap
+	// data holds the index entries, which follow the file header in the memory map.
+	data []byte
+	// size is the number of bytes of index entries.
 	size uint64
+	// headerSize is the size of the file header.
+	headerSize uint64
 }
 
 // Read takes in an index offset and returns the index offset,
 // its starting byte in the record store, and an error if any.
 func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
-	if i.size == 0 {
-		return 0, 0, io.EOF
-	}
+	n := i.size / indexLenNumBytes
 	// Return offset and pos of last record if `in` is -1
 	if in == -1 {
-		out = uint32((i.size / indexLenNumBytes) - 1)
-	} else {
-		out = uint32(in)
+		in = int64(n) - 1
 	}
-
-	indexEntryPos := uint64(out) * indexLenNumBytes
-	if i.size < indexEntryPos+indexLenNumBytes {
+	if in < 0 || uint64(in) >= n {
 		return 0, 0, io.EOF
 	}
+
+	indexEntryPos := uint64(in) * indexLenNumBytes
 	// record offset
-	out = enc.Uint32(i.mmap[indexEntryPos : indexEntryPos+offsetLenNumBytes])
+	out = enc.Uint32(i.data[indexEntryPos : indexEntryPos+offsetLenNumBytes])
 	// byte the record starts at in the store
-	pos = enc.Uint64(i.mmap[indexEntryPos+offsetLenNumBytes : indexEntryPos+indexLenNumBytes])
+	pos = enc.Uint64(i.data[indexEntryPos+offsetLenNumBytes : indexEntryPos+indexLenNumBytes])
 	return out, pos, nil
 }
 
+// Floor returns the number of the last index entry whose relative offset is at or before `off`,
+// or of the first entry if every entry is after it. It returns io.EOF if the index is empty.
+// Entry n usually holds relative offset n, so it is checked first.
+// Otherwise, the entries of a sparse or compacted segment are binary searched.
+func (i *index) Floor(off uint32) (int64, error) {
+	n := i.size / indexLenNumBytes
+	if n == 0 {
+		return 0, io.EOF
+	}
+	if uint64(off) < n {
+		if out, _, err := i.Read(int64(off)); err == nil && out == off {
+			return int64(off), nil
+		}
+	}
+	j := sort.Search(int(n), func(j int) bool {
+		out, _, _ := i.Read(int64(j))
+		return out > off
+	})
+	if j == 0 {
+		return 0, nil
+	}
+	return int64(j - 1), nil
+}
+
+// SearchPos returns the number of index entries whose position in the store is before `pos`.
+func (i *index) SearchPos(pos uint64) int64 {
+	return int64(sort.Search(int(i.size/indexLenNumBytes), func(j int) bool {
+		_, entryPos, _ := i.Read(int64(j))
+		return entryPos >= pos
+	}))
+}
+
 // Write writes an index entry into the index.
 // The offset argument index entry's offset, which is relative to the record's offset.
 func (i *index) Write(off uint32, pos uint64) error {
 	// Check if mmap has enough space to add a new index entry.
-	if uint64(len(i.mmap)) < i.size+indexLenNumBytes {
+	if uint64(len(i.data)) < i.size+indexLenNumBytes {
 		return io.EOF
 	}
-	enc.PutUint32(i.mmap[i.size:i.size+offsetLenNumBytes], off)
-	enc.PutUint64(i.mmap[i.size+offsetLenNumBytes:i.size+indexLenNumBytes], pos)
+	enc.PutUint32(i.data[i.size:i.size+offsetLenNumBytes], off)
+	enc.PutUint64(i.data[i.size+offsetLenNumBytes:i.size+indexLenNumBytes], pos)
 	i.size += indexLenNumBytes
 	return nil
 }
@@ -66,7 +101,7 @@ func (i *index) Close() error {
 	}
 	// To get the offset of the last record, we look at the last index entry.
 	// Hence, we truncate the file so that the last 12 bytes of the file correspond to the last index entry.
-	if err := i.file.Truncate(int64(i.size)); err != nil {
+	if err := i.file.Truncate(int64(i.headerSize + i.size)); err != nil {
 		return err
 	}
 	return i.file.Close()
@@ -76,6 +111,42 @@ func (i *index) Name() string {
 	return i.file.Name()
 }
 
+// Entries returns the number of leading index entries which are well-formed,
+// i.e. each entry's relative offset and position are after the previous entry's.
+// The offsets are usually consecutive, but compacted segments have gaps between them.
+// If the process crashed before the index was closed, the file is still padded with zeros
+// up to MaxIndexBytes, and the padding is not counted.
+// It also reports whether any non-zero bytes follow the well-formed entries, which means the index is damaged.
+func (i *index) Entries() (n uint64, garbage bool) {
+	var prevOff uint32
+	var prevPos uint64
+	for ; (n+1)*indexLenNumBytes <= i.size; n++ {
+		indexEntryPos := n * indexLenNumBytes
+		off := enc.Uint32(i.data[indexEntryPos : indexEntryPos+offsetLenNumBytes])
+		pos := enc.Uint64(i.data[indexEntryPos+offsetLenNumBytes : indexEntryPos+indexLenNumBytes])
+		if n > 0 && (off <= prevOff || pos <= prevPos) {
+			break
+		}
+		prevOff, prevPos = off, pos
+	}
+	for j := n * indexLenNumBytes; j < i.size; j++ {
+		if i.data[j] != 0 {
+			return n, true
+		}
+	}
+	return n, false
+}
+
+// Truncate discards every index entry from entry `n` onwards.
+func (i *index) Truncate(n uint64) {
+	size := n * indexLenNumBytes
+	// Zero the discarded entries so that they cannot be mistaken for well-formed entries later.
+	for j := size; j < i.size && j < uint64(len(i.data)); j++ {
+		i.data[j] = 0
+	}
+	i.size = size
+}
+
 func newIndex(f *os.File, c Config) (*index, error) {
 	idx := &index{
 		file: f,
@@ -84,10 +155,19 @@ func newIndex(f *os.File, c Config) (*index, error) {
 	if err != nil {
 		return nil, err
 	}
-	idx.size = uint64(fi.Size())
+	if idx.headerSize, err = fileHeaderSize(f, indexMagic, timeIndexMagic); err != nil {
+		return nil, err
+	}
+	idx.size = uint64(fi.Size()) - idx.headerSize
+	// Truncating the file to MaxIndexBytes would cut off its last entries, so it must be opened with
+	// the MaxIndexBytes it was written with, or a larger one.
+	if idx.size > c.Segment.MaxIndexBytes {
+		return nil, fmt.Errorf("index %s holds %d bytes of entries, more than MaxIndexBytes of %d",
+			f.Name(), idx.size, c.Segment.MaxIndexBytes)
+	}
 
-	// Make the index file the max size and create a memory map from the index file.
-	err = os.Truncate(f.Name(), int64(c.Segment.MaxIndexBytes))
+	// Make the index file big enough for MaxIndexBytes of entries and create a memory map from the index file.
+	err = os.Truncate(f.Name(), int64(idx.headerSize+c.Segment.MaxIndexBytes))
 	if err != nil {
 		return nil, err
 	}
@@ -99,5 +179,6 @@ func newIndex(f *os.File, c Config) (*index, error) {
 	); err != nil {
 		return nil, err
 	}
+	idx.data = idx.mmap[idx.headerSize:]
 	return idx, nil
 }
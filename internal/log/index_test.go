@@ -42,6 +42,9 @@ func TestIndex(t *testing.T) {
 
 	_, _, err = idx.Read(int64(len(entries)))
 	require.Equal(t, io.EOF, err)
+	// Entry numbers past 32 bits do not wrap around to the first entries.
+	_, _, err = idx.Read(1 << 32)
+	require.Equal(t, io.EOF, err)
 
 	err = idx.Close()
 	require.NoError(t, err)
@@ -54,4 +57,46 @@ func TestIndex(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, uint32(1), off)
 	require.Equal(t, entries[1].Pos, pos)
+	require.NoError(t, idx.Close())
+
+	// An index with more entries than MaxIndexBytes allows is not cut down to it.
+	f, _ = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	defer f.Close()
+	c.Segment.MaxIndexBytes = indexLenNumBytes
+	_, err = newIndex(f, c)
+	require.Error(t, err)
+	fi, err := os.Stat(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(2*indexLenNumBytes), fi.Size())
+}
+
+func TestIndexFloor(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_floor_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	var c Config
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+
+	_, err = idx.Floor(0)
+	require.Equal(t, io.EOF, err)
+
+	// A sparse or compacted segment has gaps between its offsets.
+	for i, off := range []uint32{1, 2, 5, 9} {
+		require.NoError(t, idx.Write(off, uint64(i)*10))
+	}
+	n, garbage := idx.Entries()
+	require.Equal(t, uint64(4), n)
+	require.False(t, garbage)
+
+	for off, want := range map[uint32]int64{0: 0, 1: 0, 2: 1, 3: 1, 4: 1, 5: 2, 8: 2, 9: 3, 100: 3} {
+		got, err := idx.Floor(off)
+		require.NoError(t, err)
+		require.Equal(t, want, got, "offset %d", off)
+	}
+	for pos, want := range map[uint64]int64{0: 0, 1: 1, 10: 1, 25: 3, 31: 4} {
+		require.Equal(t, want, idx.SearchPos(pos), "position %d", pos)
+	}
 }
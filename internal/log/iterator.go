@@ -0,0 +1,172 @@
+package log
+
+import (
+	"github.com/golang/protobuf/proto"
+
+	api "github.com/jxofficial/log/api/v1"
+)
+
+// iteratorReadAhead is the number of records an iterator reads from a segment at a time.
+const iteratorReadAhead = 64
+
+// Iterator reads the log's records in offset order, skipping the offsets removed by compaction.
+// It holds on to the segments it has yet to read, so it keeps reading them even if they are removed
+// from the log by the retention policy, Truncate or compaction in the meantime,
+// and it moves on to the segments created after it as the log rolls.
+//
+// Next returns false once the iterator has read every record appended so far.
+// If Err returns nil, Next can be called again to read the records appended since.
+// The iterator must be closed once it is no longer used. It is not safe for concurrent use.
+type Iterator struct {
+	log *Log
+	// segments are the segments left to read, starting with the segment being read.
+	// The iterator holds a reference to each of them.
+	segments []*segment
+	// next is the offset of the next record to read.
+	next uint64
+	// buf holds the records read ahead from the segment being read.
+	buf    []*api.Record
+	record *api.Record
+	err    error
+}
+
+// Iterator returns an iterator reading the log's records from offset `from` onwards.
+// It returns api.ErrOffsetTruncated if the record at `from` has been removed,
+// and api.ErrOffsetOutOfRange if `from` is past the offset the next appended record will get.
+func (l *Log) Iterator(from uint64) (*Iterator, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if err := l.checkReadFrom(from); err != nil {
+		return nil, err
+	}
+	it := &Iterator{log: l, next: from}
+	for _, s := range l.segments[l.segmentIndex(from):] {
+		s.acquire()
+		it.segments = append(it.segments, s)
+	}
+	return it, nil
+}
+
+// checkReadFrom returns api.ErrOffsetTruncated if the record at `from` has been removed,
+// and api.ErrOffsetOutOfRange if `from` is past the offset the next appended record will get.
+// The caller must hold the log's lock.
+func (l *Log) checkReadFrom(from uint64) error {
+	if lowest := l.segments[0].baseOffset; from < lowest {
+		if from >= l.Segment.InitialOffset {
+			return api.ErrOffsetTruncated{Offset: from, LowestOffset: lowest}
+		}
+		return api.ErrOffsetOutOfRange{Offset: from}
+	}
+	if from > l.activeSegment.nextOffset {
+		return api.ErrOffsetOutOfRange{Offset: from}
+	}
+	return nil
+}
+
+// Next reads the next record, and returns false if there is none yet or reading it failed.
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if len(it.buf) == 0 {
+		if it.err = it.fill(); it.err != nil || len(it.buf) == 0 {
+			return false
+		}
+	}
+	it.record, it.buf = it.buf[0], it.buf[1:]
+	it.next = it.record.Offset + 1
+	return true
+}
+
+// Record returns the record read by the last call to Next which returned true.
+func (it *Iterator) Record() *api.Record {
+	return it.record
+}
+
+// Err returns the error which stopped the iterator, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the segments the iterator has yet to read.
+func (it *Iterator) Close() error {
+	it.log.mu.RLock()
+	defer it.log.mu.RUnlock()
+	var err error
+	for _, s := range it.segments {
+		if releaseErr := s.release(); err == nil {
+			err = releaseErr
+		}
+	}
+	it.segments = nil
+	return err
+}
+
+// fill reads the next records into the buffer, moving on to the next segment once a segment is read in full.
+// The buffer is left empty if every record appended so far has been read.
+func (it *Iterator) fill() error {
+	// The active segment may be appended to while it is read.
+	it.log.mu.RLock()
+	defer it.log.mu.RUnlock()
+	for len(it.segments) > 0 {
+		s := it.segments[0]
+		records, err := s.readRange(it.next, iteratorReadAhead)
+		if err != nil {
+			return err
+		}
+		if len(records) > 0 {
+			it.buf = records
+			return nil
+		}
+		// Only a segment followed by another segment is read in full, as the active segment can still grow.
+		if len(it.segments) == 1 {
+			it.addNewSegments()
+			if len(it.segments) == 1 {
+				return nil
+			}
+		}
+		if err = s.release(); err != nil {
+			return err
+		}
+		it.segments = it.segments[1:]
+		if it.next < it.segments[0].baseOffset {
+			it.next = it.segments[0].baseOffset
+		}
+	}
+	return nil
+}
+
+// addNewSegments adds the segments created since the last segment the iterator holds.
+// The caller must hold the log's lock.
+func (it *Iterator) addNewSegments() {
+	last := it.segments[len(it.segments)-1].baseOffset
+	for _, s := range it.log.segments {
+		if s.baseOffset > last {
+			s.acquire()
+			it.segments = append(it.segments, s)
+		}
+	}
+}
+
+// ReadRange returns the records from offset `from` onwards, up to `maxRecords` records and `maxBytes` bytes
+// of marshalled records. Zero limits are not applied. The first record is returned even if it is larger
+// than `maxBytes`, so that a reader always makes progress. Offsets removed by compaction are skipped.
+// It returns api.ErrOffsetTruncated or api.ErrOffsetOutOfRange like Iterator does.
+func (l *Log) ReadRange(from uint64, maxRecords int, maxBytes uint64) ([]*api.Record, error) {
+	it, err := l.Iterator(from)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	var records []*api.Record
+	var size uint64
+	for (maxRecords <= 0 || len(records) < maxRecords) && it.Next() {
+		n := uint64(proto.Size(it.Record()))
+		if maxBytes > 0 && len(records) > 0 && size+n > maxBytes {
+			break
+		}
+		records = append(records, it.Record())
+		size += n
+	}
+	return records, it.Err()
+}
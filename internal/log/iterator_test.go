@@ -0,0 +1,151 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	api "github.com/jxofficial/log/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIterator(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, log *Log){
+		"read range applies its limits":               testReadRange,
+		"read range out of the log fails":             testReadRangeOutOfRange,
+		"iterator keeps reading truncated segments":   testIteratorTruncated,
+		"iterator reads the segments rolled after it": testIteratorRolled,
+		"iterator keeps reading uncompacted segments": testIteratorCompacted,
+		"read range skips the offsets of compaction":  testReadRangeCompacted,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "iterator_test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			// Each segment holds three records, so the log has the segments [0, 3), [3, 6) and [6, 9).
+			c.Segment.MaxIndexBytes = 3 * indexLenNumBytes
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			for i := 0; i < 8; i++ {
+				_, err := log.Append(&api.Record{Key: []byte{'a' + byte(i%2)}, Value: []byte(fmt.Sprintf("record %d", i))})
+				require.NoError(t, err)
+			}
+			require.Len(t, log.segments, 3)
+			fn(t, log)
+		})
+	}
+}
+
+// requireOffsets checks that the records have the offsets `want`.
+func requireOffsets(t *testing.T, records []*api.Record, want ...uint64) {
+	t.Helper()
+	got := make([]uint64, len(records))
+	for i, record := range records {
+		got[i] = record.Offset
+		require.Equal(t, fmt.Sprintf("record %d", record.Offset), string(record.Value))
+	}
+	require.Equal(t, want, got)
+}
+
+// iterate reads every record the iterator has, and checks that it stopped without an error.
+func iterate(t *testing.T, it *Iterator) []*api.Record {
+	t.Helper()
+	var records []*api.Record
+	for it.Next() {
+		records = append(records, it.Record())
+	}
+	require.NoError(t, it.Err())
+	return records
+}
+
+func testReadRange(t *testing.T, log *Log) {
+	records, err := log.ReadRange(1, 4, 0)
+	require.NoError(t, err)
+	requireOffsets(t, records, 1, 2, 3, 4)
+
+	records, err = log.ReadRange(5, 0, 0)
+	require.NoError(t, err)
+	requireOffsets(t, records, 5, 6, 7)
+
+	// The first record is returned even if it is over the byte limit.
+	size := uint64(proto.Size(records[0]))
+	records, err = log.ReadRange(5, 0, 2*size+1)
+	require.NoError(t, err)
+	requireOffsets(t, records, 5, 6)
+	records, err = log.ReadRange(5, 0, 1)
+	require.NoError(t, err)
+	requireOffsets(t, records, 5)
+
+	records, err = log.ReadRange(8, 0, 0)
+	require.NoError(t, err)
+	require.Empty(t, records)
+}
+
+func testReadRangeOutOfRange(t *testing.T, log *Log) {
+	_, err := log.ReadRange(9, 0, 0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 9}, err)
+
+	require.NoError(t, log.Truncate(2))
+	_, err = log.ReadRange(1, 0, 0)
+	require.Equal(t, api.ErrOffsetTruncated{Offset: 1, LowestOffset: 3}, err)
+}
+
+func testIteratorTruncated(t *testing.T, log *Log) {
+	it, err := log.Iterator(0)
+	require.NoError(t, err)
+	defer it.Close()
+	require.True(t, it.Next())
+	require.Equal(t, uint64(0), it.Record().Offset)
+
+	// The segments are removed from the log and the directory, but the iterator still reads them.
+	require.NoError(t, log.Truncate(5))
+	_, err = os.Stat(path.Join(log.Dir, "0.store"))
+	require.True(t, os.IsNotExist(err))
+	records := iterate(t, it)
+	requireOffsets(t, records, 1, 2, 3, 4, 5, 6, 7)
+}
+
+func testIteratorRolled(t *testing.T, log *Log) {
+	it, err := log.Iterator(6)
+	require.NoError(t, err)
+	defer it.Close()
+	requireOffsets(t, iterate(t, it), 6, 7)
+
+	// The iterator has read every record, and reads the records appended since, in new segments too.
+	for i := 8; i < 11; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 4)
+	requireOffsets(t, iterate(t, it), 8, 9, 10)
+}
+
+func testIteratorCompacted(t *testing.T, log *Log) {
+	it, err := log.Iterator(0)
+	require.NoError(t, err)
+	defer it.Close()
+
+	// The iterator keeps reading the segments as they were when it was created.
+	require.NoError(t, log.Compact())
+	_, err = log.Read(0)
+	require.Equal(t, api.ErrOffsetCompacted{Offset: 0}, err)
+	requireOffsets(t, iterate(t, it), 0, 1, 2, 3, 4, 5, 6, 7)
+	require.NoError(t, it.Close())
+
+	// The replaced files are closed once the iterator is closed.
+	_, err = log.Read(4)
+	require.Equal(t, api.ErrOffsetCompacted{Offset: 4}, err)
+}
+
+func testReadRangeCompacted(t *testing.T, log *Log) {
+	require.NoError(t, log.Compact())
+	records, err := log.ReadRange(0, 0, 0)
+	require.NoError(t, err)
+	requireOffsets(t, records, 6, 7)
+}
@@ -0,0 +1,72 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// lockFileName is the name of the file in the log's directory which the log holds a lock on while it is open.
+const lockFileName = "log.lock"
+
+// ErrLogLocked is returned by NewLog when the log's directory is already opened by another Log,
+// in this or another process.
+type ErrLogLocked struct {
+	Dir string
+	// PID is the ID of the process holding the lock, or 0 if it is not known.
+	PID int
+}
+
+func (e *ErrLogLocked) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("log directory %s is locked by another process", e.Dir)
+	}
+	return fmt.Sprintf("log directory %s is locked by process %d", e.Dir, e.PID)
+}
+
+// lock takes an exclusive advisory lock on the lock file in the log's directory, and writes the process ID to it.
+// The lock is released when the lock file is closed, or the process exits.
+func (l *Log) lock() error {
+	f, err := os.OpenFile(path.Join(l.Dir, lockFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return &ErrLogLocked{Dir: l.Dir, PID: lockHolder(f)}
+		}
+		return err
+	}
+	// The lock file is not removed when the log is closed, so it may hold the ID of a process which has exited.
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.lockFile = f
+	return nil
+}
+
+// lockHolder returns the ID of the process which wrote the lock file, or 0 if it cannot be read.
+func lockHolder(f *os.File) int {
+	b := make([]byte, 32)
+	n, _ := f.ReadAt(b, 0)
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(b[:n])))
+	return pid
+}
+
+// unlock releases the lock on the log's directory.
+func (l *Log) unlock() error {
+	if l.lockFile == nil {
+		return nil
+	}
+	err := l.lockFile.Close()
+	l.lockFile = nil
+	return err
+}
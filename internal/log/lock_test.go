@@ -0,0 +1,47 @@
+package log
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log_lock_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+
+	// The lock is per open file, so a second Log in the same process cannot take it either.
+	_, err = NewLog(dir, Config{})
+	var locked *ErrLogLocked
+	require.True(t, errors.As(err, &locked))
+	require.Equal(t, &ErrLogLocked{Dir: dir, PID: os.Getpid()}, locked)
+
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+
+	// Resetting the log keeps it locked.
+	require.NoError(t, log.Reset())
+	_, err = NewLog(dir, Config{})
+	require.True(t, errors.As(err, &locked))
+
+	// Closing the log releases the lock even if a segment fails to close.
+	require.NoError(t, log.segments[0].store.File.Close())
+	require.Error(t, log.Close())
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+
+	// Removing the log releases the lock.
+	require.NoError(t, log.Remove())
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+}
@@ -1,15 +1,16 @@
 package log
 
 import (
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/proto"
 	api "github.com/jxofficial/log/api/v1"
 	"io"
-	"io/ioutil"
+	"math"
 	"os"
-	"path"
 	"sort"
-	"strconv"
-	"strings"
 	"sync"
+	"time"
 )
 
 type Log struct {
@@ -19,6 +20,31 @@ type Log struct {
 	mu            sync.RWMutex
 	activeSegment *segment
 	segments      []*segment
+	repairs       []SegmentRepair
+
+	// pending holds the Append calls waiting to be committed,
+	// and committing is true while a caller is committing them.
+	pendingMu  sync.Mutex
+	pending    []*appendRequest
+	committing bool
+
+	// unsynced is the number of records appended since the last sync.
+	unsynced uint64
+	// syncErr holds the error of a failed background sync until it is returned by Append.
+	syncErr error
+
+	// cache holds recently appended and read records, or is nil if the cache is disabled.
+	cache *recordCache
+
+	// lockFile holds the lock on the log's directory while the log is open.
+	lockFile *os.File
+
+	// rewriteMu ensures only one compaction or rekey rewrites segments at a time.
+	rewriteMu sync.Mutex
+
+	// stop is closed when the log is closed to stop the background goroutines.
+	stop       chan struct{}
+	background sync.WaitGroup
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
@@ -28,41 +54,115 @@ func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	if c.Segment.TimeIndexIntervalBytes == 0 {
+		c.Segment.TimeIndexIntervalBytes = 4096
+	}
+	if c.Durability.Records == 0 {
+		c.Durability.Records = 100
+	}
+	if c.Durability.Interval == 0 {
+		c.Durability.Interval = time.Second
+	}
+	if c.Retention.CheckInterval == 0 {
+		c.Retention.CheckInterval = time.Minute
+	}
+	if c.Compaction.TombstoneRetention == 0 {
+		c.Compaction.TombstoneRetention = 24 * time.Hour
+	}
+	if c.Encryption.KeyFile != "" {
+		keyring, err := LoadKeyring(c.Encryption.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Encryption.keyring = keyring
+	}
 	l := &Log{
 		Dir:    dir,
 		Config: c,
 	}
-	return l, l.setup()
+	if c.Cache.MaxBytes > 0 {
+		l.cache = newRecordCache(c.Cache.MaxBytes)
+	}
+	// Another Log using the same directory would overwrite the segments' files from under this one.
+	if err := l.lock(); err != nil {
+		return nil, err
+	}
+	if err := l.setup(); err != nil {
+		l.unlock()
+		return nil, err
+	}
+	return l, nil
 }
 
 // setup setups the log using the store and index files in `log.Dir`
 func (l *Log) setup() error {
-	// Read all store and index files in the directory.
-	files, err := ioutil.ReadDir(l.Dir)
-	if err != nil {
+	if err := l.openSegments(); err != nil {
 		return err
 	}
-	var baseOffsets []uint64
-	for _, file := range files {
-		// each store and index file is prefixed with the offset of the first entry in the file.
-		// e.g. 30.store means the file holds records starting from offset 30.
-		offsetStr := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
-		// bitSize 0 means the value will fit into an `int`.
-		offset, _ := strconv.ParseUint(offsetStr, 10, 0)
-		baseOffsets = append(baseOffsets, offset)
-	}
 
-	sort.Slice(baseOffsets, func(i, j int) bool {
-		return baseOffsets[i] < baseOffsets[j]
-	})
+	l.stop = make(chan struct{})
+	if l.Durability.Mode == SyncInterval {
+		l.every(l.Durability.Interval, func() {
+			if err := l.Sync(); err != nil {
+				l.mu.Lock()
+				l.syncErr = err
+				l.mu.Unlock()
+			}
+		})
+	}
+	if l.Retention.MaxAge > 0 || l.Retention.MaxBytes > 0 {
+		l.every(l.Retention.CheckInterval, func() {
+			// A failed removal is retried on the next check.
+			_ = l.EnforceRetention()
+		})
+	}
+	if l.Compaction.Interval > 0 {
+		l.every(l.Compaction.Interval, func() {
+			// A failed compaction is retried on the next run.
+			_ = l.Compact()
+		})
+	}
+	return nil
+}
 
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
+// openSegments opens the segments in `log.Dir`, or creates the first segment if there is none.
+// A restore interrupted by a crash is finished first.
+func (l *Log) openSegments() error {
+	if err := finishRestore(l.Dir); err != nil {
+		return err
+	}
+	segments, err := scanDir(l.Dir)
+	if err != nil {
+		return err
+	}
+	// Orphan indexes are only removed once the directory is known to hold a consistent log,
+	// so that a refused directory is left as it was.
+	var orphans []segmentFiles
+	for _, files := range segments {
+		if !files.exts[storeExt] {
+			orphans = append(orphans, files)
+			l.repairs = append(l.repairs, SegmentRepair{BaseOffset: files.baseOffset, RemovedOrphanIndex: true})
+			continue
+		}
+		// A segment without an index rebuilds its index from the store.
+		if err = l.newSegment(files.baseOffset); err != nil {
+			l.closeSegments()
+			return err
+		}
+	}
+	if problems := l.checkSegments(); len(problems) > 0 {
+		l.closeSegments()
+		return &DirError{Dir: l.Dir, Problems: problems}
+	}
+	if err = l.dropTornBatch(); err != nil {
+		l.closeSegments()
+		return err
+	}
+	for _, files := range orphans {
+		if err = removeOrphanIndexes(l.Dir, files); err != nil {
+			l.closeSegments()
 			return err
 		}
-		// `baseOffsets` slice contains duplicate offset as it includes store and index.
-		// Ignore the duplicate offset.
-		i++
 	}
 
 	// No store or index files in the log.
@@ -76,53 +176,385 @@ func (l *Log) setup() error {
 
 // Append appends a record to the log, and returns the record's offset.
 func (l *Log) Append(record *api.Record) (uint64, error) {
+	return l.commit([]*api.Record{record})
+}
+
+// ErrEmptyBatch is returned when a batch without records is appended, as it has no first offset to return.
+var ErrEmptyBatch = errors.New("empty batch")
+
+// AppendBatch appends the records to the log with consecutive offsets, and returns the offset of the first record.
+// The batch is appended atomically: if any record cannot be appended, none of them are.
+// If the batch does not fit into the active segment, it continues in a new segment. The whole batch is discarded
+// when the log is opened again if the process crashed before it was written in full, see dropTornBatch.
+// It returns ErrEmptyBatch if there are no records.
+func (l *Log) AppendBatch(records []*api.Record) (uint64, error) {
+	if len(records) == 0 {
+		return 0, ErrEmptyBatch
+	}
+	return l.commit(records)
+}
+
+// commit appends the records to the log, and returns the offset of the first record.
+// Concurrent calls are committed together: one caller writes the records of every waiting caller
+// and syncs them once, as required by the durability policy, while the others wait for their offsets.
+func (l *Log) commit(records []*api.Record) (uint64, error) {
+	req := &appendRequest{
+		records: records,
+		done:    make(chan struct{}),
+		promote: make(chan struct{}),
+	}
+	l.pendingMu.Lock()
+	l.pending = append(l.pending, req)
+	leader := !l.committing
+	l.committing = true
+	l.pendingMu.Unlock()
+
+	if !leader {
+		select {
+		case <-req.done:
+			return req.offset, req.err
+		case <-req.promote:
+		}
+	}
+	l.commitPending()
+	return req.offset, req.err
+}
+
+// appendRequest is a call to Append or AppendBatch waiting to be committed.
+type appendRequest struct {
+	records []*api.Record
+	// offset is the offset of the first record.
+	offset uint64
+	err    error
+	// done is closed once the records have been committed.
+	done chan struct{}
+	// promote is closed if the request becomes the leader which commits the pending requests.
+	promote chan struct{}
+}
+
+// commitPending appends every pending request's records to the log and syncs them once.
+// Only one caller commits at a time. Once done, it promotes the first request
+// which arrived in the meantime to commit the next group.
+func (l *Log) commitPending() {
+	l.pendingMu.Lock()
+	reqs := l.pending
+	l.pending = nil
+	l.pendingMu.Unlock()
+
+	if s := l.appendLocked(reqs); s != nil {
+		l.syncCommitted(s, reqs)
+	}
+	for _, req := range reqs {
+		close(req.done)
+	}
+
+	l.pendingMu.Lock()
+	defer l.pendingMu.Unlock()
+	if len(l.pending) == 0 {
+		l.committing = false
+		return
+	}
+	close(l.pending[0].promote)
+}
+
+// appendLocked appends the requests' records to the log under the lock, and returns the segment to sync
+// as required by the durability policy, if any, see appendRequests.
+// If appending panics, the requests which have not failed yet fail with the panic as their error,
+// so that the lock is released and the waiting callers are not left blocked.
+func (l *Log) appendLocked(reqs []*appendRequest) (toSync *segment) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	defer func() {
+		if r := recover(); r != nil {
+			for _, req := range reqs {
+				if req.err == nil {
+					req.offset, req.err = 0, fmt.Errorf("append: %v", r)
+				}
+			}
+		}
+	}()
+	return l.appendRequests(reqs)
+}
 
-	off, err := l.activeSegment.Append(record)
-	if err != nil {
-		return 0, err
+// appendRequests appends the requests' records to the log. If the durability policy requires the records
+// to be synced, it returns the active segment, acquired so that it stays open until it has been synced.
+// The caller must hold the lock.
+func (l *Log) appendRequests(reqs []*appendRequest) (toSync *segment) {
+	if err := l.syncErr; err != nil {
+		l.syncErr = nil
+		for _, req := range reqs {
+			req.err = err
+		}
+		return nil
+	}
+	var appended uint64
+	for _, req := range reqs {
+		if req.offset, req.err = l.appendBatch(req.records); req.err == nil {
+			appended += uint64(len(req.records))
+		}
+	}
+	if l.needsSync(appended) {
+		toSync = l.activeSegment
+		toSync.acquire()
+	}
+	if l.cache == nil {
+		return toSync
+	}
+	// Consumers tailing the log read the records which were just appended.
+	for _, req := range reqs {
+		if req.err != nil {
+			continue
+		}
+		for _, record := range req.records {
+			// The caller keeps its records, and may modify them.
+			l.cache.put(proto.Clone(record).(*api.Record))
+		}
+	}
+	return toSync
+}
+
+// syncCommitted syncs the segment the requests' records were appended to, and releases it.
+// The segment is synced without the lock, so that reads and the next appends do not wait for the disk.
+// The requests fail if it cannot be synced.
+func (l *Log) syncCommitted(s *segment, reqs []*appendRequest) {
+	err := s.Sync()
+	// The log keeps its own reference to a segment in the log, so the lock is not needed to release it.
+	if releaseErr := s.release(); err == nil {
+		err = releaseErr
+	}
+	if err == nil {
+		return
+	}
+	for _, req := range reqs {
+		if req.err == nil {
+			req.offset, req.err = 0, err
+		}
+	}
+}
+
+// appendBatch appends the records to the active segment, creating a new active segment whenever it is maxed,
+// and returns the offset of the first record. If any record cannot be appended, the records which were
+// appended are removed again, also if appending panics, e.g. on a nil record. The caller must hold the lock.
+func (l *Log) appendBatch(records []*api.Record) (off uint64, err error) {
+	first := l.activeSegment.nextOffset
+	numSegments := len(l.segments)
+	defer func() {
+		if r := recover(); r != nil {
+			off, err = 0, fmt.Errorf("append: %v", r)
+			if rollbackErr := l.rollback(numSegments, first); rollbackErr != nil {
+				err = rollbackErr
+			}
+		}
+	}()
+	for len(records) > 0 {
+		n, err := l.activeSegment.AppendBatch(records)
+		if err == nil && l.activeSegment.IsMaxed() {
+			err = l.roll()
+		}
+		if err != nil {
+			if rollbackErr := l.rollback(numSegments, first); rollbackErr != nil {
+				return 0, rollbackErr
+			}
+			return 0, err
+		}
+		records = records[n:]
 	}
-	if l.activeSegment.IsMaxed() {
-		// create a new segment for the log, and set it as the active segment.
-		err = l.newSegment(off + 1)
+	return first, nil
+}
+
+// roll syncs the maxed active segment, and creates a new active segment after it.
+// The caller must hold the lock.
+func (l *Log) roll() error {
+	// Sync the maxed segment as it will not be appended to again.
+	if err := l.activeSegment.sealTimeIndex(); err != nil {
+		return err
+	}
+	if err := l.activeSegment.Sync(); err != nil {
+		return err
+	}
+	l.unsynced = 0
+	// create a new segment for the log, and set it as the active segment.
+	return l.newSegment(l.activeSegment.nextOffset)
+}
+
+// rollback removes the segments created after the first `numSegments` segments,
+// and the records from offset `off` onwards from the segment which was active before them.
+// The caller must hold the lock.
+func (l *Log) rollback(numSegments int, off uint64) error {
+	for _, s := range l.segments[numSegments:] {
+		if err := s.Remove(); err != nil {
+			return err
+		}
+	}
+	l.segments = l.segments[:numSegments]
+	l.activeSegment = l.segments[numSegments-1]
+	l.activeSegment.store.unseal()
+	return l.activeSegment.Truncate(off)
+}
+
+// needsSync reports whether the durability policy requires the active segment to be synced
+// after `n` records have been appended. The caller must hold the lock.
+func (l *Log) needsSync(n uint64) bool {
+	switch l.Durability.Mode {
+	case SyncEveryAppend:
+		return true
+	case SyncEveryN:
+		l.unsynced += n
+		if l.unsynced >= l.Durability.Records {
+			l.unsynced = 0
+			return true
+		}
+	}
+	return false
+}
+
+// Sync commits every record appended to the log to disk, regardless of the durability policy.
+// Appends and reads go on while the segment is synced.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	l.unsynced = 0
+	// Segments other than the active segment were synced when they were maxed.
+	s := l.activeSegment
+	s.acquire()
+	l.mu.Unlock()
+	err := s.Sync()
+	if releaseErr := s.release(); err == nil {
+		err = releaseErr
 	}
-	return off, err
+	return err
+}
+
+// every runs fn in a background goroutine once every interval, until the log is closed.
+func (l *Log) every(interval time.Duration, fn func()) {
+	l.background.Add(1)
+	go func(stop chan struct{}) {
+		defer l.background.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-stop:
+				return
+			}
+		}
+	}(l.stop)
 }
 
 func (l *Log) Read(offset uint64) (*api.Record, error) {
+	segment, err := l.readSegment(offset)
+	if err != nil {
+		return nil, err
+	}
+	if segment != nil {
+		// The segment is sealed, so it is read without the lock, and appends do not hold up the read.
+		// The log keeps its own reference to a segment in the log, so the lock is not needed to release it.
+		defer segment.release()
+	} else {
+		// The active segment is appended to while it is read.
+		l.mu.RLock()
+		defer l.mu.RUnlock()
+		if segment, err = l.segmentFor(offset); err != nil {
+			return nil, err
+		}
+	}
+	if l.cache != nil {
+		if record := l.cache.get(offset); record != nil {
+			return record, nil
+		}
+	}
+	record, err := segment.Read(offset)
+	// The offset is within the segment's range, so its record was removed by compaction.
+	if err == io.EOF {
+		return nil, api.ErrOffsetCompacted{Offset: offset}
+	}
+	if err == nil && l.cache != nil {
+		l.cache.put(proto.Clone(record).(*api.Record))
+	}
+	return record, err
+}
+
+// readSegment returns the sealed segment holding `offset`, acquired so that it stays open while it is read
+// without the lock. It returns nil if the offset is in the active segment.
+func (l *Log) readSegment(offset uint64) (*segment, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	segment, err := l.segmentFor(offset)
+	if err != nil || segment == l.activeSegment {
+		return nil, err
+	}
+	segment.acquire()
+	return segment, nil
+}
+
+// segmentFor returns the segment holding `offset`. The caller must hold the lock.
+func (l *Log) segmentFor(offset uint64) (*segment, error) {
 	var segment *segment
-	// Find the segment which houses the record having the provided offset.
-	for _, s := range l.segments {
-		// We need the second condition because we cannot just take the first occurrence of offset > baseOffset.
-		// The first segment could hold offsets of 0 - 10, and if the offset is 15,
-		// then the record is actually found in the second segment.
-		if offset >= s.baseOffset && offset < s.nextOffset {
-			segment = s
-			break
-		}
-	}
-	// Second condition is technically not needed as `segment` will already be nil
-	// if you pass in an offset like 10000000,
-	// as it will not satisfy the condition of offset < s.nextOffset in the for loop.
-	if segment == nil || offset >= segment.nextOffset {
+	// A sealed segment's offsets run up to the next segment's base offset,
+	// as compaction may have removed the records at the end of the segment.
+	if i := l.segmentIndex(offset); i >= 0 && (i < len(l.segments)-1 || offset < l.segments[i].nextOffset) {
+		segment = l.segments[i]
+	}
+	if segment == nil {
+		// The offset was in the log, but its segment has since been removed.
+		if lowest := l.segments[0].baseOffset; offset < lowest && offset >= l.Segment.InitialOffset {
+			return nil, api.ErrOffsetTruncated{Offset: offset, LowestOffset: lowest}
+		}
 		return nil, api.ErrOffsetOutOfRange{Offset: offset}
 	}
-	return segment.Read(offset)
+	return segment, nil
 }
 
-// Close closes all the segments.
+// CacheStats returns the use of the record cache so far. It is zero if the cache is disabled.
+func (l *Log) CacheStats() CacheStats {
+	if l.cache == nil {
+		return CacheStats{}
+	}
+	return l.cache.stats()
+}
+
+// segmentIndex returns the index of the last segment whose base offset is at or before `offset`,
+// i.e. of the segment which would hold it, or -1 if `offset` is before every segment.
+// The segments are sorted by base offset, so they are binary searched.
+// The caller must hold the log's lock.
+func (l *Log) segmentIndex(offset uint64) int {
+	return sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].baseOffset > offset
+	}) - 1
+}
+
+// Close closes all the segments, and releases the lock on the log's directory.
 func (l *Log) Close() error {
+	// Stop the background goroutines before the segments are closed.
+	if l.stop != nil {
+		close(l.stop)
+		l.background.Wait()
+		l.stop = nil
+	}
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	// Every segment is closed even if one fails to, so that no segment file is left in use.
+	var err error
 	for _, s := range l.segments {
-		if err := s.Close(); err != nil {
-			return err
+		if closeErr := s.Close(); err == nil {
+			err = closeErr
 		}
 	}
-	return nil
+	// The lock is only released once no segment file is in use,
+	// and is released even if a segment failed to close, so that the log can be opened again.
+	if unlockErr := l.unlock(); err == nil {
+		err = unlockErr
+	}
+	return err
+}
+
+// closeSegments closes the segments opened by a setup which failed.
+func (l *Log) closeSegments() {
+	for _, s := range l.segments {
+		s.Close()
+	}
+	l.segments, l.activeSegment = nil, nil
 }
 
 // Remove closes the log and removes all the associated files.
@@ -138,7 +570,21 @@ func (l *Log) Reset() error {
 	if err := l.Remove(); err != nil {
 		return err
 	}
-	return l.setup()
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	l.segments, l.activeSegment, l.repairs = nil, nil, nil
+	if l.cache != nil {
+		l.cache.remove(0, math.MaxUint64)
+	}
+	if err := l.lock(); err != nil {
+		return err
+	}
+	if err := l.setup(); err != nil {
+		l.unlock()
+		return err
+	}
+	return nil
 }
 
 // helper methods
@@ -146,7 +592,7 @@ func (l *Log) Reset() error {
 // LowestOffset returns the offset of the earliest record in the log.
 func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.RLock()
-	l.mu.RUnlock()
+	defer l.mu.RUnlock()
 	return l.segments[0].baseOffset, nil
 }
 
@@ -162,31 +608,52 @@ func (l *Log) HighestOffset() (uint64, error) {
 }
 
 // Truncate removes all segments whose highest offset is lower or equal to the `lowest` argument.
+// The active segment is never removed.
 func (l *Log) Truncate(lowest uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	var segments []*segment
-	for _, s := range l.segments {
-		if s.nextOffset-1 <= lowest {
-			if err := s.Remove(); err != nil {
-				return err
-			}
-			continue
-		}
-		segments = append(segments, s)
+	var n int
+	for n < len(l.segments)-1 && l.segments[n].nextOffset <= lowest+1 {
+		n++
 	}
-	l.segments = segments
-	return nil
+	_, err := l.removeOldest(n, RemovedByTruncate)
+	return err
 }
 
-func (l *Log) Reader() io.Reader {
+// Reader returns a reader of the entries in every segment's store.
+// The stores' file headers are not included, so the entries can be written to a store without a header,
+// which is upgraded when it is opened. The entries are a snapshot of the log, which Restore reads back.
+// The segments stay readable while they are removed from the log, until the reader is closed.
+func (l *Log) Reader() io.ReadCloser {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	readers := make([]io.Reader, len(l.segments))
 	for i, s := range l.segments {
+		s.acquire()
 		readers[i] = &originalReader{s.store, 0}
 	}
-	return io.MultiReader(readers...)
+	return &logReader{Reader: io.MultiReader(readers...), log: l, segments: append([]*segment(nil), l.segments...)}
+}
+
+// logReader reads the entries of the segments it holds a reference to.
+type logReader struct {
+	io.Reader
+	log      *Log
+	segments []*segment
+}
+
+// Close releases the segments.
+func (r *logReader) Close() error {
+	r.log.mu.RLock()
+	defer r.log.mu.RUnlock()
+	var err error
+	for _, s := range r.segments {
+		if releaseErr := s.release(); err == nil {
+			err = releaseErr
+		}
+	}
+	r.segments = nil
+	return err
 }
 
 type originalReader struct {
@@ -200,12 +667,30 @@ func (o *originalReader) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// Repairs returns what was repaired in the log's segments when the log was set up,
+// e.g. partially written records left behind by a crash.
+func (l *Log) Repairs() []SegmentRepair {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.repairs
+}
+
 // newSegment appends a new segment to `log.segments`, and sets it as the activeSegment.
 func (l *Log) newSegment(baseOffset uint64) error {
 	s, err := newSegment(l.Dir, baseOffset, l.Config)
 	if err != nil {
 		return err
 	}
+	// The active segment is sealed, as it is not appended to once the new segment is active.
+	if l.activeSegment != nil {
+		if err = l.activeSegment.store.seal(); err != nil {
+			s.Close()
+			return err
+		}
+	}
+	if s.repair != nil {
+		l.repairs = append(l.repairs, *s.repair)
+	}
 	l.segments = append(l.segments, s)
 	l.activeSegment = s
 	return nil
@@ -1,21 +1,37 @@
 package log
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/golang/protobuf/proto"
 	api "github.com/jxofficial/log/api/v1"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"io/ioutil"
+	"math"
 	"os"
+	"path"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestLog(t *testing.T) {
 	for scenario, fn := range map[string]func(t *testing.T, log *Log){
-		"append and read a record succeeds":    testAppendRead,
-		"read out of range returns an error":   testOutOfRangeErr,
-		"log retains state after being closed": testInitExisting,
-		"reader":                               testReader,
-		"truncate":                             testTruncate,
+		"append and read a record succeeds":     testAppendRead,
+		"read out of range returns an error":    testOutOfRangeErr,
+		"log retains state after being closed":  testInitExisting,
+		"reader":                                testReader,
+		"reader keeps truncated segments":       testReaderTruncate,
+		"truncate":                              testTruncate,
+		"read corrupt record returns an error":  testCorruptRecord,
+		"log repairs torn records on setup":     testRepairOnSetup,
+		"log rebuilds deleted index on setup":   testRebuildIndexOnSetup,
+		"append batch rolls segments":           testAppendBatch,
+		"append rolls at last segment offset":   testRollAtOffsetBoundary,
+		"append nil record returns an error":    testAppendNilRecord,
+		"append empty batch returns an error":   testAppendEmptyBatch,
+		"batch torn across segments is dropped": testTornBatchAcrossSegments,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "log_test")
@@ -23,7 +39,8 @@ func TestLog(t *testing.T) {
 			defer os.RemoveAll(dir)
 
 			c := Config{}
-			c.Segment.MaxStoreBytes = 32
+			// Each segment holds two records.
+			c.Segment.MaxStoreBytes = 64
 			log, err := NewLog(dir, c)
 			require.NoError(t, err)
 
@@ -32,6 +49,93 @@ func TestLog(t *testing.T) {
 	}
 }
 
+func testTornBatchAcrossSegments(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	// The batch's records 1 and 2 are in segment 0 and segment 2, and the log rolls to segment 4 after it.
+	batch := []*api.Record{{Value: []byte("second")}, {Value: []byte("third")}, {Value: []byte("fourth")}}
+	_, err = log.AppendBatch(batch)
+	require.NoError(t, err)
+	require.Len(t, log.segments, 3)
+	_, lastPos, err := log.segments[1].index.Read(1)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	// A clean shutdown keeps the batch.
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	require.Empty(t, log.Repairs())
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), highest)
+	require.NoError(t, log.Close())
+
+	// The batch's last record never made it to disk, and neither did segment 4.
+	require.NoError(t, os.Truncate(path.Join(log.Dir, "2"+storeExt), int64(fileHeaderNumBytes+lastPos)))
+	for _, ext := range []string{storeExt, indexExt, timeIndexExt} {
+		require.NoError(t, os.Remove(path.Join(log.Dir, "4"+ext)))
+	}
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Len(t, log.Repairs(), 2)
+	for _, repair := range log.Repairs() {
+		require.True(t, repair.DiscardedBatchPart)
+	}
+	require.Len(t, log.segments, 1)
+	_, err = log.Read(1)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 1}, err)
+	off, err := log.Append(&api.Record{Value: []byte("second")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
+
+func testAppendNilRecord(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+
+	// The batch fills the active segment before reaching the nil record in a new segment.
+	batch := []*api.Record{{Value: []byte("second")}, {Value: []byte("third")}, nil}
+	_, err = log.AppendBatch(batch)
+	require.Error(t, err)
+	require.Len(t, log.segments, 1)
+	_, err = log.Read(1)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 1}, err)
+
+	// The log is not left locked.
+	off, err := log.Append(&api.Record{Value: []byte("second")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
+
+func testAppendEmptyBatch(t *testing.T, log *Log) {
+	for _, batch := range [][]*api.Record{nil, {}} {
+		_, err := log.AppendBatch(batch)
+		require.Equal(t, ErrEmptyBatch, err)
+	}
+	off, err := log.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+}
+
+func testRollAtOffsetBoundary(t *testing.T, log *Log) {
+	// The active segment holds a record at its last offset, and has room in its store and index.
+	last := uint64(math.MaxUint32)
+	require.NoError(t, log.activeSegment.AppendAt(&api.Record{Offset: last, Value: []byte("hello world")}))
+	require.False(t, log.activeSegment.store.size >= log.Segment.MaxStoreBytes)
+
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, last+1, off)
+	require.Len(t, log.segments, 2)
+	require.Equal(t, last+1, log.activeSegment.baseOffset)
+	for _, off := range []uint64{last, last + 1} {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+	}
+}
+
 func testAppendRead(t *testing.T, log *Log) {
 	r := &api.Record{
 		Value: []byte("hello world"),
@@ -89,17 +193,44 @@ func testReader(t *testing.T, log *Log) {
 	require.Equal(t, uint64(0), offset)
 
 	reader := log.Reader()
+	defer reader.Close()
 	b, err := ioutil.ReadAll(reader)
-	// Length of "hello world" in byte slice is 13, + recordLenNumBytes (8) = 21.
-	require.Equal(t, 21, len(b))
+	// The record as marshalled by the log, with its offset and timestamp, + entryHeaderNumBytes (12).
+	require.Equal(t, proto.Size(r)+entryHeaderNumBytes, len(b))
 	require.NoError(t, err)
 
 	recordFromLog := &api.Record{}
-	err = proto.Unmarshal(b[recordLenNumBytes:], recordFromLog)
+	err = proto.Unmarshal(b[entryHeaderNumBytes:], recordFromLog)
 	require.NoError(t, err)
 	require.Equal(t, r.Value, recordFromLog.Value)
 }
 
+func testReaderTruncate(t *testing.T, log *Log) {
+	r := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(r)
+		require.NoError(t, err)
+	}
+	reader := log.Reader()
+	// The segment holding records 0 and 1 is removed while the reader has yet to read it.
+	require.NoError(t, log.Truncate(1))
+	b, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+
+	snapshot, err := ioutil.TempDir("", "log_reader_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(snapshot)
+	restored, err := NewLogFromSnapshot(snapshot, Config{}, bytes.NewReader(b))
+	require.NoError(t, err)
+	defer restored.Close()
+	records, err := restored.ReadRange(0, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+}
+
 func testTruncate(t *testing.T, log *Log) {
 	r := &api.Record{
 		Value: []byte("hello world"),
@@ -113,11 +244,504 @@ func testTruncate(t *testing.T, log *Log) {
 	require.NoError(t, err)
 
 	// First segment contains records with offset 0 and 1.
-	// Each record entry in the store should be 21 bytes:
-	// 8 bytes to hold the len (13) and the record which is 13 bytes long.
+	// Each record entry in the store is about 40 bytes:
+	// 8 bytes to hold the len, 4 bytes to hold the checksum and the record with its timestamp.
 	_, err = log.Read(1)
 	require.Error(t, err)
 
 	_, err = log.Read(2)
 	require.NoError(t, err)
 }
+
+func testCorruptRecord(t *testing.T, log *Log) {
+	r := &api.Record{
+		Value: []byte("hello world"),
+	}
+	offset, err := log.Append(r)
+	require.NoError(t, err)
+	_, err = log.Read(offset)
+	require.NoError(t, err)
+	// Reads do not flush the store's buffer, so the record is written to the store file first.
+	require.NoError(t, log.Sync())
+
+	// Flip the last byte of the record in the store file.
+	f, err := os.OpenFile(path.Join(log.Dir, "0.store"), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	defer f.Close()
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, fi.Size()-1)
+	require.NoError(t, err)
+
+	_, err = log.Read(offset)
+	require.Equal(t, api.ErrCorruptRecord{Offset: offset}, err)
+}
+
+func testRepairOnSetup(t *testing.T, crashedLog *Log) {
+	r := &api.Record{
+		Value: []byte("hello world"),
+	}
+	off, err := crashedLog.Append(r)
+	require.NoError(t, err)
+	// Syncing writes the record to the store file.
+	require.NoError(t, crashedLog.Sync())
+	require.Empty(t, crashedLog.Repairs())
+
+	// Write the length prefix of a record which never made it to disk.
+	f, err := os.OpenFile(path.Join(crashedLog.Dir, "0.store"), os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.Write([]byte{0x80, 0, 0, 0, 0, 0, 0, 13})
+	require.NoError(t, err)
+
+	// The lock on the directory is released when the process exits.
+	require.NoError(t, crashedLog.unlock())
+	log, err := NewLog(crashedLog.Dir, crashedLog.Config)
+	require.NoError(t, err)
+	require.Equal(t, []SegmentRepair{{BaseOffset: 0, TruncatedStoreBytes: 8}}, log.Repairs())
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, off, highest)
+	_, err = log.Read(off)
+	require.NoError(t, err)
+}
+
+func testRebuildIndexOnSetup(t *testing.T, existingLog *Log) {
+	r := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := existingLog.Append(r)
+		require.NoError(t, err)
+	}
+	require.NoError(t, existingLog.Close())
+	// The first segment holds offsets 0 and 1.
+	require.NoError(t, os.Remove(path.Join(existingLog.Dir, "0.index")))
+
+	log, err := NewLog(existingLog.Dir, existingLog.Config)
+	require.NoError(t, err)
+	require.Equal(t, []SegmentRepair{{
+		BaseOffset:            0,
+		RecoveredIndexEntries: 2,
+		RebuiltIndex:          true,
+	}}, log.Repairs())
+	for i := uint64(0); i < 3; i++ {
+		read, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, r.Value, read.Value)
+	}
+}
+
+func TestLogDurability(t *testing.T) {
+	// The record has a fixed timestamp, so that the size of each entry is known.
+	r := &api.Record{
+		Value:     []byte("hello world"),
+		Timestamp: timestamppb.New(time.Unix(1600000000, 0)),
+	}
+	// The first record's offset is the zero value and is not marshalled,
+	// so the following entries are 2 bytes longer.
+	// The file header is written when the store is created.
+	header := int64(fileHeaderNumBytes)
+	var sizes []int64
+	size := header
+	for i := 0; i < 3; i++ {
+		size += int64(proto.Size(&api.Record{Value: r.Value, Offset: uint64(i), Timestamp: r.Timestamp}))
+		size += int64(entryHeaderNumBytes)
+		sizes = append(sizes, size)
+	}
+
+	for scenario, tc := range map[string]struct {
+		mode    SyncMode
+		records uint64
+		// want is the size of the store file on disk after each of three appends.
+		want []int64
+	}{
+		"OS decides keeps records buffered": {mode: SyncOS, want: []int64{header, header, header}},
+		"every append syncs each record":    {mode: SyncEveryAppend, want: sizes},
+		"every N syncs every second record": {mode: SyncEveryN, records: 2, want: []int64{header, sizes[1], sizes[1]}},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log_durability_test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Durability.Mode = tc.mode
+			c.Durability.Records = tc.records
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			for _, want := range tc.want {
+				_, err = log.Append(r)
+				require.NoError(t, err)
+				_, size, err := openFile(path.Join(dir, "0.store"))
+				require.NoError(t, err)
+				require.Equal(t, want, size)
+			}
+
+			// Sync commits every record regardless of the mode.
+			require.NoError(t, log.Sync())
+			_, size, err := openFile(path.Join(dir, "0.store"))
+			require.NoError(t, err)
+			require.Equal(t, sizes[2], size)
+		})
+	}
+
+	t.Run("interval syncs in the background", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "log_durability_test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		c := Config{}
+		c.Durability.Mode = SyncInterval
+		c.Durability.Interval = 10 * time.Millisecond
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+		defer log.Close()
+
+		_, err = log.Append(r)
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			_, size, err := openFile(path.Join(dir, "0.store"))
+			return err == nil && size == sizes[0]
+		}, time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestLogConcurrentAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log_concurrent_append_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Durability.Mode = SyncEveryAppend
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	const producers, records = 8, 50
+	offsets := make(chan uint64, producers*records)
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < records; i++ {
+				value := []byte(fmt.Sprintf("producer %d record %d", p, i))
+				off, err := log.Append(&api.Record{Value: value})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				// Each caller gets the offset of its own record.
+				read, err := log.Read(off)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if string(read.Value) != string(value) {
+					t.Errorf("got value %q at offset %d, want %q", read.Value, off, value)
+				}
+				offsets <- off
+			}
+		}(p)
+	}
+	wg.Wait()
+	close(offsets)
+
+	seen := make(map[uint64]bool)
+	for off := range offsets {
+		require.False(t, seen[off])
+		seen[off] = true
+	}
+	require.Len(t, seen, producers*records)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(producers*records-1), highest)
+}
+
+// BenchmarkAppend compares concurrent appends committed as a group
+// against appending and syncing one record at a time.
+func BenchmarkAppend(b *testing.B) {
+	for name, appendFn := range map[string]func(log *Log, r *api.Record) error{
+		"group commit": func(log *Log, r *api.Record) error {
+			_, err := log.Append(r)
+			return err
+		},
+		"one at a time": func(log *Log, r *api.Record) error {
+			log.mu.Lock()
+			defer log.mu.Unlock()
+			if _, err := log.appendBatch([]*api.Record{r}); err != nil {
+				return err
+			}
+			if !log.needsSync(1) {
+				return nil
+			}
+			return log.activeSegment.Sync()
+		},
+	} {
+		b.Run(name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "log_append_bench")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1 << 30
+			c.Segment.MaxIndexBytes = 1 << 24
+			c.Durability.Mode = SyncEveryAppend
+			log, err := NewLog(dir, c)
+			require.NoError(b, err)
+			defer log.Close()
+
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := &api.Record{Value: []byte("hello world")}
+				for pb.Next() {
+					if err := appendFn(log, proto.Clone(r).(*api.Record)); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkReadParallel compares concurrent reads of records in a sealed segment,
+// which are read without locking, against concurrent reads of records in the active segment.
+func BenchmarkReadParallel(b *testing.B) {
+	// The log has two segments of 500 records each: the first is sealed, and the second is active.
+	const records = 500
+	for name, base := range map[string]uint64{
+		"sealed segment": 0,
+		"active segment": records,
+	} {
+		b.Run(name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "log_read_parallel_bench")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxIndexBytes = records * indexLenNumBytes
+			c.Segment.MaxStoreBytes = 1 << 20
+			log, err := NewLog(dir, c)
+			require.NoError(b, err)
+			defer log.Close()
+			batch := make([]*api.Record, 2*records-1)
+			for i := range batch {
+				batch[i] = &api.Record{Value: []byte("hello world")}
+			}
+			_, err = log.AppendBatch(batch)
+			require.NoError(b, err)
+			require.Len(b, log.segments, 2)
+
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				var off uint64
+				for pb.Next() {
+					if _, err := log.Read(base + off%(records-1)); err != nil {
+						b.Error(err)
+					}
+					off += 7
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkReadWhileAppending reads records of a sealed segment while a writer appends and syncs every record,
+// to check that reads of sealed segments do not wait for appends or for the disk.
+func BenchmarkReadWhileAppending(b *testing.B) {
+	for name, mode := range map[string]SyncMode{
+		"sync os":           SyncOS,
+		"sync every append": SyncEveryAppend,
+	} {
+		b.Run(name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "log_read_while_appending_bench")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+
+			// The first segment holds 500 records, and is sealed.
+			const records = 500
+			c := Config{}
+			c.Segment.MaxIndexBytes = records * indexLenNumBytes
+			c.Segment.MaxStoreBytes = 1 << 20
+			c.Durability.Mode = mode
+			log, err := NewLog(dir, c)
+			require.NoError(b, err)
+			defer log.Close()
+			batch := make([]*api.Record, records)
+			for i := range batch {
+				batch[i] = &api.Record{Value: []byte("hello world")}
+			}
+			_, err = log.AppendBatch(batch)
+			require.NoError(b, err)
+			require.Len(b, log.segments, 2)
+
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if _, err := log.Append(&api.Record{Value: []byte("hello world")}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			}()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				var off uint64
+				for pb.Next() {
+					if _, err := log.Read(off % records); err != nil {
+						b.Error(err)
+					}
+					off += 7
+				}
+			})
+			b.StopTimer()
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
+
+func TestSegmentIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segment_index_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	// Each segment holds three records, so the log has the segments [10, 13), [13, 16) and [16, 18).
+	c.Segment.MaxIndexBytes = 3 * indexLenNumBytes
+	c.Segment.InitialOffset = 10
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	appendRecords(t, log, 8)
+	require.Len(t, log.segments, 3)
+
+	for off, want := range map[uint64]int{
+		// Before the first segment.
+		0: -1,
+		9: -1,
+		// At a segment's base offset, and at its last offset.
+		10: 0,
+		12: 0,
+		13: 1,
+		15: 1,
+		16: 2,
+		17: 2,
+		// Past the last segment.
+		18:  2,
+		100: 2,
+	} {
+		require.Equal(t, want, log.segmentIndex(off), "offset %d", off)
+		read, err := log.Read(off)
+		if off < 10 || off > 17 {
+			require.Equal(t, api.ErrOffsetOutOfRange{Offset: off}, err)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+	}
+}
+
+// BenchmarkRead reads records spread over logs of increasing numbers of segments,
+// to check that finding the segment holding an offset does not slow down as the log grows.
+func BenchmarkRead(b *testing.B) {
+	// Each segment keeps three files open, so the largest log stays well within a limit of 1024 open files.
+	// BenchmarkSegmentIndex looks up offsets in logs with far more segments.
+	for _, segments := range []int{1, 10, 100, 300} {
+		b.Run(fmt.Sprintf("%d segments", segments), func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "log_read_bench")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+
+			// Each segment holds a single record.
+			c := Config{}
+			c.Segment.MaxIndexBytes = indexLenNumBytes
+			log, err := NewLog(dir, c)
+			require.NoError(b, err)
+			defer log.Close()
+			batch := make([]*api.Record, segments)
+			for i := range batch {
+				batch[i] = &api.Record{Value: []byte("hello world")}
+			}
+			_, err = log.AppendBatch(batch)
+			require.NoError(b, err)
+
+			b.ResetTimer()
+			var off uint64
+			for i := 0; i < b.N; i++ {
+				if _, err := log.Read(off % uint64(segments)); err != nil {
+					b.Fatal(err)
+				}
+				off += 7
+			}
+			// Closing the segments is not part of the benchmark.
+			b.StopTimer()
+		})
+	}
+}
+
+func BenchmarkSegmentIndex(b *testing.B) {
+	// The segments only exist in memory, so the log can have far more segments than it could keep open.
+	for _, segments := range []int{1, 100, 10000, 100000} {
+		b.Run(fmt.Sprintf("%d segments", segments), func(b *testing.B) {
+			// Each segment holds ten offsets.
+			log := &Log{segments: make([]*segment, segments)}
+			for i := range log.segments {
+				log.segments[i] = &segment{baseOffset: uint64(i) * 10}
+			}
+			highest := uint64(segments) * 10
+
+			b.ResetTimer()
+			var off uint64
+			for i := 0; i < b.N; i++ {
+				if j := log.segmentIndex(off % highest); j < 0 {
+					b.Fatalf("no segment for offset %d", off%highest)
+				}
+				off += 7
+			}
+		})
+	}
+}
+
+func testAppendBatch(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+
+	var batch []*api.Record
+	for i := 0; i < 5; i++ {
+		batch = append(batch, &api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+	}
+	first, err := log.AppendBatch(batch)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+
+	// The batch continues in new segments as each segment holds two records.
+	require.Len(t, log.segments, 4)
+	// Only the active segment is appended to.
+	for _, s := range log.segments {
+		require.Equal(t, s != log.activeSegment, s.store.isSealed())
+	}
+	for i, want := range batch {
+		read, err := log.Read(first + uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, want.Value, read.Value)
+	}
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), highest)
+}
@@ -0,0 +1,165 @@
+package log
+
+import (
+	"io"
+	"os"
+
+	api "github.com/jxofficial/log/api/v1"
+)
+
+// Raw entries are the store entries of records as they are in the segments' stores, for followers and snapshots
+// to copy without decoding and encoding every record. Each entry is an 8-byte big-endian length prefix,
+// whose most significant byte holds the entry's attributes and whose remaining 56 bits hold the length of the
+// record data, followed by a 4-byte CRC32 checksum if the entry has attributes, and by the record data.
+// The record data is the marshalled record, or the records of a batch compressed together, see attrRecordBatch,
+// compressed and then encrypted as the entry's attributes say.
+
+// rawEntry is a store entry in a chunk of raw entries.
+type rawEntry struct {
+	attrs byte
+	// data is the record data as it is in the store.
+	data []byte
+	// len is the length of the entry in bytes, including its length prefix and checksum.
+	len uint64
+}
+
+// parseRawEntry verifies the raw entry at the start of `b` and returns it.
+// It returns errCorruptEntry if the entry is partially in `b` or fails its integrity check.
+func parseRawEntry(b []byte) (rawEntry, error) {
+	if len(b) < int(recordLenNumBytes) {
+		return rawEntry{}, errCorruptEntry
+	}
+	lenBytes := b[:recordLenNumBytes]
+	// Raw entries may be copied from a store with legacy entries, which only the source store knows.
+	attrs, size, headerLen, err := parseEntryHeader(lenBytes, true)
+	if err != nil {
+		return rawEntry{}, err
+	}
+	if headerLen+size > uint64(len(b)) {
+		return rawEntry{}, errCorruptEntry
+	}
+	data := b[headerLen : headerLen+size]
+	if attrs&attrChecksum != 0 && enc.Uint32(b[recordLenNumBytes:headerLen]) != checksum(lenBytes, data) {
+		return rawEntry{}, errCorruptEntry
+	}
+	return rawEntry{attrs: attrs, data: data, len: headerLen + size}, nil
+}
+
+// records decrypts, decompresses and unmarshals the entry's records.
+func (e rawEntry) records(keyring *Keyring) ([]*api.Record, error) {
+	p, err := decodeEntryData(e.data, e.attrs, keyring)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalRecords(p, e.attrs)
+}
+
+// DecodeRaw returns the records of a chunk of raw entries, see ReadRaw.
+// Encrypted entries are decrypted with the keyring, which may be nil if no entry is encrypted.
+func DecodeRaw(entries []byte, keyring *Keyring) ([]*api.Record, error) {
+	var records []*api.Record
+	for len(entries) > 0 {
+		entry, err := parseRawEntry(entries)
+		if err != nil {
+			return nil, err
+		}
+		entryRecords, err := entry.records(keyring)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, entryRecords...)
+		entries = entries[entry.len:]
+	}
+	return records, nil
+}
+
+// ReadRaw returns the raw entries of the records from offset `from` onwards, up to `maxBytes` bytes
+// but at least one entry, and the offset to read the next chunk from. The chunk is read from a single segment.
+// Offsets removed by compaction are skipped. A chunk which starts with the entry of a batch compressed together
+// may hold records before `from`, see Segment.BatchCompression. An empty chunk is returned if no record has been appended from `from`
+// onwards yet. It returns api.ErrOffsetTruncated or api.ErrOffsetOutOfRange like Iterator does.
+func (l *Log) ReadRaw(from, maxBytes uint64) ([]byte, uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if err := l.checkReadFrom(from); err != nil {
+		return nil, 0, err
+	}
+	for _, s := range l.segments[l.segmentIndex(from):] {
+		b, next, err := s.readRaw(from, maxBytes)
+		if err == io.EOF {
+			// The rest of the segment was removed by compaction.
+			from = s.nextOffset
+			continue
+		}
+		return b, next, err
+	}
+	return nil, from, nil
+}
+
+// RawSection is the part of a sealed segment's store holding the raw entries of its records
+// from a given offset onwards. It keeps the segment's files open until it is closed,
+// even if the segment is removed from the log in the meantime, so it can be copied from the file directly.
+type RawSection struct {
+	// FirstOffset is the offset of the section's first record from the requested offset onwards.
+	// A section which starts with the entry of a batch compressed together may hold records before it.
+	// NextOffset is the offset after the segment's last record, and the base offset of the next segment.
+	FirstOffset uint64
+	NextOffset  uint64
+	// File is the segment's store file. The section is the Length bytes of the file from Offset.
+	File   *os.File
+	Offset int64
+	Length int64
+
+	log     *Log
+	segment *segment
+}
+
+// Reader returns a reader of the section's raw entries.
+func (r *RawSection) Reader() *io.SectionReader {
+	return io.NewSectionReader(r.File, r.Offset, r.Length)
+}
+
+// Close releases the section's segment.
+func (r *RawSection) Close() error {
+	r.log.mu.RLock()
+	defer r.log.mu.RUnlock()
+	return r.segment.release()
+}
+
+// RawSections returns the sections of the sealed segments holding the records from offset `from` onwards.
+// The records of the active segment, which is still appended to, are not included, and are read with ReadRaw.
+// Each section must be closed once it has been copied.
+// It returns api.ErrOffsetTruncated or api.ErrOffsetOutOfRange like Iterator does.
+func (l *Log) RawSections(from uint64) ([]*RawSection, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if err := l.checkReadFrom(from); err != nil {
+		return nil, err
+	}
+	var sections []*RawSection
+	i := l.segmentIndex(from)
+	for ; i < len(l.segments)-1; i++ {
+		s := l.segments[i]
+		first, pos, err := s.position(from)
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			for _, section := range sections {
+				section.segment.release()
+			}
+			return nil, err
+		}
+		s.acquire()
+		sections = append(sections, &RawSection{
+			FirstOffset: first.Offset,
+			NextOffset:  l.segments[i+1].baseOffset,
+			File:        s.store.File,
+			Offset:      int64(s.store.headerSize + pos),
+			Length:      int64(s.store.size - pos),
+			log:         l,
+			segment:     s,
+		})
+	}
+	return sections, nil
+}
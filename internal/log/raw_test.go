@@ -0,0 +1,144 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	api "github.com/jxofficial/log/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRaw(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, log *Log){
+		"read raw returns chunks of whole entries":   testReadRaw,
+		"read raw skips the offsets of compaction":   testReadRawCompacted,
+		"read raw stops before a corrupt entry":      testReadRawCorrupt,
+		"raw sections hold the sealed segments":      testRawSections,
+		"raw sections outlive their removed segment": testRawSectionsTruncated,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "raw_test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			// Each segment holds three records, so the log has the segments [0, 3), [3, 6) and [6, 9).
+			c.Segment.MaxIndexBytes = 3 * indexLenNumBytes
+			c.Segment.Compression = CompressionSnappy
+			c.Encryption.KeyFile = writeKeyFile(t, dir, key1)
+			require.NoError(t, os.Mkdir(path.Join(dir, "log"), 0755))
+			log, err := NewLog(path.Join(dir, "log"), c)
+			require.NoError(t, err)
+			defer log.Close()
+			for i := 0; i < 8; i++ {
+				_, err := log.Append(&api.Record{Key: []byte{'a' + byte(i%2)}, Value: []byte(fmt.Sprintf("record %d", i))})
+				require.NoError(t, err)
+			}
+			fn(t, log)
+		})
+	}
+}
+
+// readRaw reads the log's raw entries in chunks of up to `maxBytes` bytes from offset `from` onwards,
+// and decodes them.
+func readRaw(t *testing.T, log *Log, from, maxBytes uint64) []*api.Record {
+	t.Helper()
+	var records []*api.Record
+	for {
+		b, next, err := log.ReadRaw(from, maxBytes)
+		require.NoError(t, err)
+		if len(b) == 0 {
+			return records
+		}
+		require.Greater(t, next, from)
+		chunk, err := DecodeRaw(b, log.Encryption.keyring)
+		require.NoError(t, err)
+		require.Equal(t, next, chunk[len(chunk)-1].Offset+1)
+		records = append(records, chunk...)
+		from = next
+	}
+}
+
+func testReadRaw(t *testing.T, log *Log) {
+	// Each chunk holds a single entry, or a whole segment.
+	requireOffsets(t, readRaw(t, log, 1, 1), 1, 2, 3, 4, 5, 6, 7)
+	requireOffsets(t, readRaw(t, log, 1, 1<<20), 1, 2, 3, 4, 5, 6, 7)
+
+	b, _, err := log.ReadRaw(0, 1<<20)
+	require.NoError(t, err)
+	_, err = DecodeRaw(b, nil)
+	require.Equal(t, errKeyNotFound, err)
+
+	_, _, err = log.ReadRaw(9, 0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 9}, err)
+}
+
+func testReadRawCompacted(t *testing.T, log *Log) {
+	require.NoError(t, log.Compact())
+	requireOffsets(t, readRaw(t, log, 0, 1<<20), 6, 7)
+}
+
+func testReadRawCorrupt(t *testing.T, log *Log) {
+	// Flip a byte of record 2's data, the last entry of segment 0.
+	s := log.segments[0]
+	_, pos, err := s.position(2)
+	require.NoError(t, err)
+	f, err := os.OpenFile(s.store.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	b := make([]byte, 1)
+	last := int64(s.store.headerSize + s.store.size - 1)
+	_, err = f.ReadAt(b, last)
+	require.NoError(t, err)
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, last)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	chunk, next, err := log.ReadRaw(0, 1<<20)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), next)
+	require.Equal(t, int(pos), len(chunk))
+	_, _, err = log.ReadRaw(2, 1<<20)
+	require.Equal(t, api.ErrCorruptRecord{Offset: 2}, err)
+}
+
+func testRawSections(t *testing.T, log *Log) {
+	sections, err := log.RawSections(1)
+	require.NoError(t, err)
+	// The active segment is not included.
+	require.Len(t, sections, 2)
+	var records []*api.Record
+	for i, section := range sections {
+		b, err := ioutil.ReadAll(section.Reader())
+		require.NoError(t, err)
+		chunk, err := DecodeRaw(b, log.Encryption.keyring)
+		require.NoError(t, err)
+		require.Equal(t, section.FirstOffset, chunk[0].Offset)
+		require.Equal(t, uint64(3*(i+1)), section.NextOffset)
+		records = append(records, chunk...)
+		require.NoError(t, section.Close())
+	}
+	requireOffsets(t, records, 1, 2, 3, 4, 5)
+}
+
+func testRawSectionsTruncated(t *testing.T, log *Log) {
+	sections, err := log.RawSections(0)
+	require.NoError(t, err)
+	require.Len(t, sections, 2)
+	require.NoError(t, log.Truncate(5))
+
+	// The section is still read after its segment's files are removed.
+	b, err := ioutil.ReadAll(sections[0].Reader())
+	require.NoError(t, err)
+	records, err := DecodeRaw(b, log.Encryption.keyring)
+	require.NoError(t, err)
+	requireOffsets(t, records, 0, 1, 2)
+	for _, section := range sections {
+		require.NoError(t, section.Close())
+	}
+	_, err = sections[0].File.Stat()
+	require.Error(t, err)
+}
@@ -0,0 +1,322 @@
+package log
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/golang/protobuf/proto"
+
+	api "github.com/jxofficial/log/api/v1"
+)
+
+// SegmentRepair describes what was repaired in a segment's files when the segment was opened.
+type SegmentRepair struct {
+	// BaseOffset is the offset of the first record in the repaired segment.
+	BaseOffset uint64
+	// TruncatedStoreBytes is the number of bytes of partially written or corrupt entries
+	// removed from the end of the store.
+	TruncatedStoreBytes uint64
+	// TruncatedIndexEntries is the number of index entries removed because they pointed
+	// past the end of the store or at partially written or corrupt entries.
+	TruncatedIndexEntries uint64
+	// RecoveredIndexEntries is the number of index entries added for complete entries
+	// in the store which were missing from the index.
+	RecoveredIndexEntries uint64
+	// RebuiltIndex is true if the index was missing or damaged,
+	// and was regenerated by scanning every entry in the store.
+	RebuiltIndex bool
+	// RemovedOrphanIndex is true if the segment's store was missing,
+	// and its index files were removed as they had nothing left to index.
+	RemovedOrphanIndex bool
+	// DiscardedBatchPart is true if the segment held part of the last batch, which continued in the next segment
+	// but was not written in full, so the part was removed. A segment which held nothing else is removed.
+	DiscardedBatchPart bool
+}
+
+// dropTornBatch discards the last batch if it continued in the next segment, but the process crashed before
+// the rest of the batch was written. Each segment recovers its own part of the batch, but only the log knows
+// whether the rest of it follows: the parts are removed from the last segments which hold the batch,
+// and the segment the batch started in becomes the active segment again.
+func (l *Log) dropTornBatch() error {
+	start := -1
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		s := l.segments[i]
+		// An empty segment holds no part of the batch, or its part was torn.
+		if s.store.size == 0 {
+			continue
+		}
+		if !s.continues {
+			break
+		}
+		start = i
+		// The batch started in this segment, unless the segment holds nothing else.
+		if s.partOffset > s.baseOffset {
+			break
+		}
+	}
+	if start < 0 {
+		return nil
+	}
+	for _, s := range l.segments[start+1:] {
+		l.addRepair(SegmentRepair{BaseOffset: s.baseOffset, TruncatedStoreBytes: s.store.size, DiscardedBatchPart: true})
+		if err := s.Remove(); err != nil {
+			return err
+		}
+	}
+	s := l.segments[start]
+	l.segments = l.segments[:start+1]
+	l.activeSegment = s
+	s.store.unseal()
+	size, entries := s.store.size, s.index.size/indexLenNumBytes
+	if err := s.Truncate(s.partOffset); err != nil {
+		return err
+	}
+	l.addRepair(SegmentRepair{
+		BaseOffset:            s.baseOffset,
+		TruncatedStoreBytes:   size - s.store.size,
+		TruncatedIndexEntries: entries - s.index.size/indexLenNumBytes,
+		DiscardedBatchPart:    true,
+	})
+	return nil
+}
+
+// addRepair merges the repair of a segment into the segment's repair from when it was opened, if any.
+func (l *Log) addRepair(r SegmentRepair) {
+	for i := range l.repairs {
+		if prev := &l.repairs[i]; prev.BaseOffset == r.BaseOffset {
+			prev.TruncatedStoreBytes += r.TruncatedStoreBytes
+			prev.TruncatedIndexEntries += r.TruncatedIndexEntries
+			prev.DiscardedBatchPart = prev.DiscardedBatchPart || r.DiscardedBatchPart
+			return
+		}
+	}
+	l.repairs = append(l.repairs, r)
+}
+
+// pendingEntry is an index entry for a record of a batch which has not been walked in full yet.
+type pendingEntry struct {
+	off uint32
+	pos uint64
+}
+
+// recover brings the segment's store and index back to a consistent state, and sets the segment's next offset.
+// If the process crashed mid-append, the store can end with a partially written entry,
+// and the index can point past the end of the store.
+// Only the entries from the last index entry onwards are validated, as every entry before them was written in full.
+// If the index disagrees with the store, it is rebuilt from the store.
+// It returns nil if nothing had to be repaired.
+func (s *segment) recover() (*SegmentRepair, error) {
+	repair := &SegmentRepair{BaseOffset: s.baseOffset}
+
+	entries, garbage := s.index.Entries()
+	n := entries
+	if garbage {
+		n = 0
+	}
+	// The first entry in the store is always at the start of the file.
+	if n > 0 {
+		if _, pos, err := s.index.Read(0); err != nil || pos != 0 {
+			n = 0
+		}
+	}
+
+	// Drop index entries from the end until the last entry points at a valid store entry holding its record.
+	for n > 0 {
+		off, pos, err := s.index.Read(int64(n - 1))
+		if err != nil {
+			return nil, err
+		}
+		records, _, _, err := s.entryRecords(pos)
+		if err == nil && records[0].Offset == s.baseOffset+uint64(off) {
+			break
+		}
+		if err != nil && err != errCorruptEntry && err != io.EOF {
+			return nil, err
+		}
+		n--
+	}
+	kept := n
+	// None of the index entries could be trusted, so every store entry has to be indexed again.
+	repair.RebuiltIndex = n == 0 && s.store.size > 0
+
+	// Step back to the start of the last index entry's batch, as the rest of the batch may not have been written.
+	// Only an entry right after the previous index entry's record can be in the middle of a batch,
+	// as a sparse index only has entries for the first record of a batch.
+	for n > 1 {
+		_, prevPos, err := s.index.Read(int64(n - 2))
+		if err != nil {
+			return nil, err
+		}
+		_, pos, err := s.index.Read(int64(n - 1))
+		if err != nil {
+			return nil, err
+		}
+		_, prevLen, attrs, err := s.store.Entry(prevPos)
+		if err != nil {
+			return nil, err
+		}
+		if prevPos+prevLen != pos || attrs&attrBatchCont == 0 {
+			break
+		}
+		n--
+	}
+	var pos uint64
+	if n > 0 {
+		var err error
+		if _, pos, err = s.index.Read(int64(n - 1)); err != nil {
+			return nil, err
+		}
+		// The walk below indexes the entry again.
+		n--
+	}
+	s.index.Truncate(n)
+
+	// Walk the store forward, indexing the complete entries up to the end of the last batch written in full.
+	// Compaction leaves gaps between offsets, so each offset is taken from the record itself.
+	storeEnd := pos
+	// The walk continues from the records up to `pos`. The last index entry's entry may hold a batch of records,
+	// and a sparse index has no entries for the records after it, so they are read to find the last offset.
+	s.nextOffset = s.baseOffset
+	if n > 0 {
+		_, prevPos, err := s.index.Read(int64(n - 1))
+		if err != nil {
+			return nil, err
+		}
+		for prevPos < pos {
+			records, entryLen, _, err := s.entryRecords(prevPos)
+			if err == errCorruptEntry {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			s.nextOffset = records[len(records)-1].Offset + 1
+			prevPos += entryLen
+		}
+	}
+	var pending []pendingEntry
+	// batchNextOffset is the next offset once the pending batch is complete,
+	// and partOffset is the offset of the batch's first record.
+	batchNextOffset := s.nextOffset
+	var partOffset uint64
+	for pos < s.store.size {
+		records, entryLen, attrs, err := s.entryRecords(pos)
+		if err == errCorruptEntry {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Offsets increase through the store.
+		first, last := records[0], records[len(records)-1]
+		if first.Offset < batchNextOffset || last.Offset < first.Offset || last.Offset-s.baseOffset > math.MaxUint32 {
+			break
+		}
+		off := uint32(first.Offset - s.baseOffset)
+		batchStart := batchNextOffset == s.nextOffset
+		if batchStart {
+			partOffset = first.Offset
+		}
+		// A sparse index only has entries for the first record of a batch, as segment.writeIndex writes them.
+		if s.config.Segment.IndexIntervalBytes == 0 ||
+			(batchStart && (n == 0 || pos >= s.indexPos(n)+s.config.Segment.IndexIntervalBytes)) {
+			pending = append(pending, pendingEntry{off: off, pos: pos})
+		}
+		batchNextOffset = last.Offset + 1
+		pos += entryLen
+		if attrs&attrBatchCont != 0 {
+			continue
+		}
+		// The batch is complete, so its entries can be indexed.
+		full := false
+		for _, e := range pending {
+			if err = s.index.Write(e.off, e.pos); err == io.EOF {
+				full = true
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if full {
+			// The index is full, so the batch cannot be kept.
+			s.index.Truncate(n)
+			break
+		}
+		n += uint64(len(pending))
+		pending = pending[:0]
+		storeEnd = pos
+		s.nextOffset = batchNextOffset
+		// The segment's part of a batch is complete, but the rest of the batch may be missing from the next segment.
+		s.continues, s.partOffset = attrs&attrBatchNextSegment != 0, partOffset
+	}
+
+	if n < kept {
+		kept = n
+	}
+	repair.TruncatedIndexEntries = entries - kept
+	repair.RecoveredIndexEntries = n - kept
+
+	if storeEnd < s.store.size {
+		repair.TruncatedStoreBytes = s.store.size - storeEnd
+		if err := s.store.Truncate(storeEnd); err != nil {
+			return nil, err
+		}
+	}
+
+	if *repair == (SegmentRepair{BaseOffset: s.baseOffset}) {
+		return nil, nil
+	}
+	return repair, nil
+}
+
+// indexPos returns the store position of the record referenced by the n-th index entry, counting from 1.
+func (s *segment) indexPos(n uint64) uint64 {
+	_, pos, _ := s.index.Read(int64(n - 1))
+	return pos
+}
+
+// entryRecords returns the records of the store entry at `pos` in offset order, the entry's length and its attributes.
+// Entries written before checksums were introduced can only be verified by unmarshalling them,
+// so a record which cannot be unmarshalled is reported as errCorruptEntry.
+func (s *segment) entryRecords(pos uint64) ([]*api.Record, uint64, byte, error) {
+	p, entryLen, attrs, err := s.store.Entry(pos)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	records, err := unmarshalRecords(p, attrs)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return records, entryLen, attrs, nil
+}
+
+// unmarshalRecords unmarshals the records of an entry's decoded record data, which holds the records of a batch
+// if the entry has attrRecordBatch, and a single record otherwise. It returns errCorruptEntry if they cannot be.
+func unmarshalRecords(p []byte, attrs byte) ([]*api.Record, error) {
+	if attrs&attrRecordBatch == 0 {
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			return nil, errCorruptEntry
+		}
+		return []*api.Record{record}, nil
+	}
+	var records []*api.Record
+	for len(p) > 0 {
+		size, n := binary.Uvarint(p)
+		if n <= 0 || size > uint64(len(p)-n) {
+			return nil, errCorruptEntry
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(p[n:n+int(size)], record); err != nil {
+			return nil, errCorruptEntry
+		}
+		records = append(records, record)
+		p = p[n+int(size):]
+	}
+	if len(records) == 0 {
+		return nil, errCorruptEntry
+	}
+	return records, nil
+}
@@ -0,0 +1,259 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	api "github.com/jxofficial/log/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegmentRecover(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string, c Config){
+		"crash without torn writes needs no repair":      testRecoverCleanCrash,
+		"partially written store entry is truncated":     testRecoverTornStore,
+		"index entries past the store are truncated":     testRecoverIndexPastStore,
+		"store entries missing from the index are added": testRecoverMissingIndexEntries,
+		"missing index is rebuilt":                       testRebuildMissingIndex,
+		"partially written batch is discarded":           testRecoverTornBatch,
+		"damaged index is rebuilt":                       testRebuildDamagedIndex,
+		"sparse index is recovered":                      testRecoverSparseIndex,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "recover_test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			c.Segment.MaxIndexBytes = 1024
+			fn(t, dir, c)
+		})
+	}
+}
+
+// crashedSegment appends `n` records to a new segment and leaves its files as they would be
+// if the process crashed: the store is flushed but the index is not truncated to its size.
+func crashedSegment(t *testing.T, dir string, c Config, n int) *segment {
+	t.Helper()
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		appendRecord(t, s, &api.Record{Value: []byte("hello world")})
+	}
+	require.NoError(t, s.store.buf.Flush())
+	return s
+}
+
+func requireReadable(t *testing.T, s *segment, n int) {
+	t.Helper()
+	require.Equal(t, uint64(16+n), s.nextOffset)
+	for i := 0; i < n; i++ {
+		got, err := s.Read(uint64(16 + i))
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), got.Value)
+	}
+}
+
+func testRecoverCleanCrash(t *testing.T, dir string, c Config) {
+	crashedSegment(t, dir, c, 3)
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Nil(t, s.repair)
+	requireReadable(t, s, 3)
+}
+
+func testRecoverTornStore(t *testing.T, dir string, c Config) {
+	crashed := crashedSegment(t, dir, c, 3)
+	// Write the length prefix and only part of the record data of a fourth entry.
+	header := make([]byte, entryHeaderNumBytes)
+	enc.PutUint64(header, uint64(attrChecksum)<<entryAttrShift|100)
+	_, err := crashed.store.File.Write(append(header, []byte("hello")...))
+	require.NoError(t, err)
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, &SegmentRepair{
+		BaseOffset:          16,
+		TruncatedStoreBytes: entryHeaderNumBytes + 5,
+	}, s.repair)
+	requireReadable(t, s, 3)
+
+	// The segment can be appended to after the repair.
+	off := appendRecord(t, s, &api.Record{Value: []byte("hello world")})
+	require.Equal(t, uint64(19), off)
+	requireReadable(t, s, 4)
+}
+
+func testRecoverIndexPastStore(t *testing.T, dir string, c Config) {
+	crashed := crashedSegment(t, dir, c, 3)
+	// The store lost its last entry, but the index still points at it.
+	_, pos, err := crashed.index.Read(2)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(crashed.store.Name(), int64(fileHeaderNumBytes+pos+3)))
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, &SegmentRepair{
+		BaseOffset:            16,
+		TruncatedStoreBytes:   3,
+		TruncatedIndexEntries: 1,
+	}, s.repair)
+	requireReadable(t, s, 2)
+}
+
+func testRecoverMissingIndexEntries(t *testing.T, dir string, c Config) {
+	crashed := crashedSegment(t, dir, c, 3)
+	// The index lost its last entry, but the store holds the complete record.
+	crashed.index.Truncate(2)
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, &SegmentRepair{
+		BaseOffset:            16,
+		RecoveredIndexEntries: 1,
+	}, s.repair)
+	requireReadable(t, s, 3)
+}
+
+func testRebuildMissingIndex(t *testing.T, dir string, c Config) {
+	crashed := crashedSegment(t, dir, c, 3)
+	require.NoError(t, os.Remove(crashed.index.Name()))
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, &SegmentRepair{
+		BaseOffset:            16,
+		RecoveredIndexEntries: 3,
+		RebuiltIndex:          true,
+	}, s.repair)
+	requireReadable(t, s, 3)
+}
+
+func testRebuildDamagedIndex(t *testing.T, dir string, c Config) {
+	crashed := crashedSegment(t, dir, c, 3)
+	// Overwrite the second index entry with garbage.
+	copy(crashed.index.data[indexLenNumBytes:], []byte("garbage garbage"))
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	// The garbage entry's offset and position are after the first entry's, as they are in a compacted segment,
+	// so both entries are truncated before the index is rebuilt.
+	require.Equal(t, &SegmentRepair{
+		BaseOffset:            16,
+		TruncatedIndexEntries: 2,
+		RecoveredIndexEntries: 3,
+		RebuiltIndex:          true,
+	}, s.repair)
+	requireReadable(t, s, 3)
+}
+
+func testRecoverTornBatch(t *testing.T, dir string, c Config) {
+	crashed := crashedSegment(t, dir, c, 1)
+	n, err := crashed.AppendBatch([]*api.Record{
+		{Value: []byte("hello world")},
+		{Value: []byte("hello world")},
+		{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	require.NoError(t, crashed.store.buf.Flush())
+	// The last entry of the batch never made it to disk.
+	_, batchPos, err := crashed.index.Read(1)
+	require.NoError(t, err)
+	_, lastPos, err := crashed.index.Read(3)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(crashed.store.Name(), int64(fileHeaderNumBytes+lastPos)))
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, &SegmentRepair{
+		BaseOffset:            16,
+		TruncatedStoreBytes:   lastPos - batchPos,
+		TruncatedIndexEntries: 3,
+	}, s.repair)
+	requireReadable(t, s, 1)
+}
+
+func testRecoverSparseIndex(t *testing.T, dir string, c Config) {
+	c.Segment.IndexIntervalBytes = 100
+	crashed := crashedSegment(t, dir, c, 10)
+	n, err := crashed.AppendBatch([]*api.Record{
+		{Value: []byte("hello world")},
+		{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.NoError(t, crashed.store.buf.Flush())
+	entries, _ := crashed.index.Entries()
+	require.Less(t, entries, uint64(10))
+
+	// A crash after the index was closed leaves the index complete.
+	clean, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Nil(t, clean.repair)
+	requireReadable(t, clean, 12)
+
+	// The last entry of the batch never made it to disk,
+	// so the batch is discarded even though its records are not indexed.
+	fi, err := os.Stat(crashed.store.Name())
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(crashed.store.Name(), fi.Size()-1))
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.NotNil(t, s.repair)
+	require.Equal(t, uint64(0), s.repair.RecoveredIndexEntries)
+	requireReadable(t, s, 10)
+}
+
+func TestLogSparseIndexReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log_sparse_index_reopen_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	configs := map[string]Config{}
+	for name, codec := range map[string]Compression{"none": CompressionNone, "snappy": CompressionSnappy, "zstd": CompressionZstd} {
+		c := Config{}
+		c.Segment.Compression = codec
+		configs[name] = c
+	}
+	c := Config{}
+	c.Encryption.KeyFile = writeKeyFile(t, dir, key1)
+	configs["encrypted"] = c
+	for name, c := range configs {
+		t.Run(name, func(t *testing.T) {
+			c.Segment.MaxStoreBytes = 1 << 20
+			c.Segment.MaxIndexBytes = 1 << 10
+			// Only the first record of a batch is indexed.
+			c.Segment.IndexIntervalBytes = 200
+			logDir := path.Join(dir, name)
+			require.NoError(t, os.Mkdir(logDir, 0755))
+			log, err := NewLog(logDir, c)
+			require.NoError(t, err)
+			// Each batch follows a single record, so that the batch starts too close to the record to be indexed,
+			// but continues past the interval.
+			for i := 0; i < 5; i++ {
+				_, err = log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+				require.NoError(t, err)
+				var batch []*api.Record
+				for j := 0; j < 10; j++ {
+					batch = append(batch, &api.Record{Value: []byte(fmt.Sprintf("batch %d record %d", i, j))})
+				}
+				_, err = log.AppendBatch(batch)
+				require.NoError(t, err)
+			}
+			index := log.activeSegment.index.size
+			require.NoError(t, log.Close())
+
+			log, err = NewLog(logDir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			require.Empty(t, log.Repairs())
+			require.Equal(t, index, log.activeSegment.index.size)
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package log
+
+import (
+	"errors"
+	"os"
+
+	api "github.com/jxofficial/log/api/v1"
+)
+
+// Rekey rewrites the sealed segments which hold records that are not encrypted with the active key
+// of `Encryption.KeyFile`, so that every record in them is encrypted with it. Records keep their offsets.
+// Once the log has rolled over to a new active segment and Rekey has run again,
+// keys other than the active key can be removed from the key file.
+func (l *Log) Rekey() (err error) {
+	if l.Encryption.keyring == nil {
+		return errors.New("rekey needs an encryption key file")
+	}
+	l.rewriteMu.Lock()
+	defer l.rewriteMu.Unlock()
+
+	sealed, _ := l.sealedSegments()
+	defer func() {
+		if releaseErr := l.releaseSegments(sealed); err == nil {
+			err = releaseErr
+		}
+	}()
+	dir, err := l.makeRewriteDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	for _, s := range sealed {
+		stale, err := s.store.EncryptedWithOtherKey()
+		if err != nil {
+			return err
+		}
+		if !stale {
+			continue
+		}
+		if err = l.rewriteSegment(dir, s, true, func(*api.Record) bool { return true }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
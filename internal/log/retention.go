@@ -0,0 +1,96 @@
+package log
+
+import (
+	"time"
+)
+
+// RemovedSegment describes a segment removed by the retention policy.
+type RemovedSegment struct {
+	// BaseOffset is the offset of the first record in the segment,
+	// and NextOffset is the offset after the last record in the segment.
+	BaseOffset, NextOffset uint64
+	// StoreBytes is the size of the segment's store.
+	StoreBytes uint64
+	// LastWrite is the time the segment was last appended to.
+	LastWrite time.Time
+	// Reason is why the segment was removed.
+	Reason RemovalReason
+}
+
+// RemovalReason is why a segment was removed from the log.
+type RemovalReason int
+
+const (
+	// RemovedByTruncate is a segment removed by Log.Truncate.
+	RemovedByTruncate RemovalReason = iota
+	// RemovedByMaxAge is a segment removed because it was older than Retention.MaxAge.
+	RemovedByMaxAge
+	// RemovedByMaxBytes is a segment removed because the log was larger than Retention.MaxBytes.
+	RemovedByMaxBytes
+)
+
+// EnforceRetention removes the segments which have expired according to the retention policy,
+// oldest first. It is run periodically in the background when a retention policy is configured.
+func (l *Log) EnforceRetention() error {
+	removed, err := l.removeRetained(time.Now())
+	if l.Retention.OnRemove != nil {
+		for _, r := range removed {
+			l.Retention.OnRemove(r)
+		}
+	}
+	return err
+}
+
+// removeRetained removes the segments which were last appended to more than `Retention.MaxAge` before `now`,
+// and then the oldest segments until the log is no larger than `Retention.MaxBytes`.
+// Segments are only removed from the start of the log, so that the remaining offsets are contiguous.
+func (l *Log) removeRetained(now time.Time) ([]RemovedSegment, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var expired int
+	if l.Retention.MaxAge > 0 {
+		for expired < len(l.segments)-1 && now.Sub(l.segments[expired].lastWrite) > l.Retention.MaxAge {
+			expired++
+		}
+	}
+	removed, err := l.removeOldest(expired, RemovedByMaxAge)
+	if err != nil || l.Retention.MaxBytes == 0 {
+		return removed, err
+	}
+
+	var size uint64
+	for _, s := range l.segments {
+		size += s.store.size
+	}
+	var oversized int
+	for ; oversized < len(l.segments)-1 && size > l.Retention.MaxBytes; oversized++ {
+		size -= l.segments[oversized].store.size
+	}
+	removedBySize, err := l.removeOldest(oversized, RemovedByMaxBytes)
+	return append(removed, removedBySize...), err
+}
+
+// removeOldest removes the first `n` segments of the log, which must not include the active segment,
+// and returns what was removed. The caller must hold the lock.
+func (l *Log) removeOldest(n int, reason RemovalReason) ([]RemovedSegment, error) {
+	var removed []RemovedSegment
+	for len(removed) < n {
+		s := l.segments[0]
+		r := RemovedSegment{
+			BaseOffset: s.baseOffset,
+			NextOffset: s.nextOffset,
+			StoreBytes: s.store.size,
+			LastWrite:  s.lastWrite,
+			Reason:     reason,
+		}
+		if err := s.Remove(); err != nil {
+			return removed, err
+		}
+		if l.cache != nil {
+			l.cache.remove(s.baseOffset, s.nextOffset)
+		}
+		l.segments = l.segments[1:]
+		removed = append(removed, r)
+	}
+	return removed, nil
+}
@@ -0,0 +1,165 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	api "github.com/jxofficial/log/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetention(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, log *Log, removed chan RemovedSegment){
+		"expired segments are removed oldest first":      testRemoveExpired,
+		"active segment is never removed":                testKeepActiveSegment,
+		"last write time survives reopening the log":     testExpiredAfterReopen,
+		"expired segments are removed in the background": testRetentionJanitor,
+		"oldest segments are removed above max bytes":    testRemoveOversized,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "retention_test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			removed := make(chan RemovedSegment, 10)
+			c := Config{}
+			c.Segment.MaxStoreBytes = 64
+			c.Retention.MaxAge = time.Hour
+			c.Retention.CheckInterval = time.Hour
+			c.Retention.OnRemove = func(r RemovedSegment) {
+				removed <- r
+			}
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			// Each segment holds two records, so the log has three segments.
+			for i := 0; i < 5; i++ {
+				_, err := log.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+			require.Len(t, log.segments, 3)
+			fn(t, log, removed)
+		})
+	}
+}
+
+func testRemoveExpired(t *testing.T, log *Log, removed chan RemovedSegment) {
+	expired := time.Now().Add(-2 * time.Hour)
+	log.segments[0].lastWrite = expired
+	log.segments[1].lastWrite = expired
+	storeBytes := log.segments[0].store.size
+
+	require.NoError(t, log.EnforceRetention())
+	require.Len(t, log.segments, 1)
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), lowest)
+	_, err = log.Read(3)
+	require.Error(t, err)
+	_, err = log.Read(4)
+	require.NoError(t, err)
+
+	require.Equal(t, RemovedSegment{
+		BaseOffset: 0,
+		NextOffset: 2,
+		StoreBytes: storeBytes,
+		LastWrite:  expired,
+		Reason:     RemovedByMaxAge,
+	}, <-removed)
+	require.Equal(t, uint64(2), (<-removed).BaseOffset)
+	_, err = os.Stat(path.Join(log.Dir, "0.store"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func testKeepActiveSegment(t *testing.T, log *Log, removed chan RemovedSegment) {
+	expired := time.Now().Add(-2 * time.Hour)
+	// A newer segment blocks the removal of the segments after it.
+	log.segments[1].lastWrite = expired
+	log.segments[2].lastWrite = expired
+	require.NoError(t, log.EnforceRetention())
+	require.Len(t, log.segments, 3)
+
+	for _, s := range log.segments {
+		s.lastWrite = expired
+	}
+	require.NoError(t, log.EnforceRetention())
+	require.Len(t, log.segments, 1)
+	require.Equal(t, log.activeSegment, log.segments[0])
+	require.Len(t, removed, 2)
+
+	// The log can still be appended to.
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+}
+
+func testExpiredAfterReopen(t *testing.T, existingLog *Log, removed chan RemovedSegment) {
+	require.NoError(t, existingLog.Close())
+	expired := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(path.Join(existingLog.Dir, "0.store"), expired, expired))
+
+	log, err := NewLog(existingLog.Dir, existingLog.Config)
+	require.NoError(t, err)
+	defer log.Close()
+	require.NoError(t, log.EnforceRetention())
+	require.Len(t, log.segments, 2)
+	require.Equal(t, uint64(0), (<-removed).BaseOffset)
+}
+
+func testRetentionJanitor(t *testing.T, existingLog *Log, removed chan RemovedSegment) {
+	require.NoError(t, existingLog.Close())
+	expired := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(path.Join(existingLog.Dir, "0.store"), expired, expired))
+
+	c := existingLog.Config
+	c.Retention.CheckInterval = 10 * time.Millisecond
+	log, err := NewLog(existingLog.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	select {
+	case r := <-removed:
+		require.Equal(t, uint64(0), r.BaseOffset)
+	case <-time.After(time.Second):
+		t.Fatal("expired segment was not removed")
+	}
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), lowest)
+}
+
+func testRemoveOversized(t *testing.T, log *Log, removed chan RemovedSegment) {
+	var size uint64
+	for _, s := range log.segments {
+		size += s.store.size
+	}
+	log.Retention.MaxBytes = size
+	require.NoError(t, log.EnforceRetention())
+	require.Len(t, log.segments, 3)
+
+	// Removing the first segment brings the log under the limit.
+	log.Retention.MaxBytes = size - 1
+	require.NoError(t, log.EnforceRetention())
+	require.Len(t, log.segments, 2)
+	r := <-removed
+	require.Equal(t, uint64(0), r.BaseOffset)
+	require.Equal(t, RemovedByMaxBytes, r.Reason)
+
+	// The active segment is kept even if it is larger than the limit on its own.
+	log.Retention.MaxBytes = 1
+	require.NoError(t, log.EnforceRetention())
+	require.Len(t, log.segments, 1)
+	require.Equal(t, uint64(2), (<-removed).BaseOffset)
+
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), lowest)
+	_, err = log.Read(1)
+	require.Equal(t, api.ErrOffsetTruncated{Offset: 1, LowestOffset: 4}, err)
+	_, err = log.Read(5)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 5}, err)
+}
@@ -1,14 +1,28 @@
 package log
 
 import (
+	"errors"
 	"fmt"
 	"github.com/golang/protobuf/proto"
+	"io"
+	"math"
 	"os"
 	"path"
+	"sync/atomic"
+	"time"
 
 	api "github.com/jxofficial/log/api/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+// maxSegmentOffsets is the number of offsets a segment can hold,
+// as index entries hold the offset of a record relative to the segment's base offset in 32 bits.
+// Offsets removed by compaction count towards it too.
+const maxSegmentOffsets uint64 = math.MaxUint32 + 1
+
+// errSegmentOffsetsFull is returned when a record's offset is past the last offset a segment can hold.
+var errSegmentOffsetsFull = errors.New("offset past the last offset of the segment")
+
 type segment struct {
 	store *store
 	index *index
@@ -16,34 +30,69 @@ type segment struct {
 	// nextOffset is the offset of the next record to be added to the segment.
 	baseOffset, nextOffset uint64
 	config                 Config
+	// repair describes what was repaired when the segment was opened, and is nil if nothing was.
+	repair *SegmentRepair
+	// lastWrite is the time the segment was last appended to.
+	lastWrite time.Time
+	// timeIndex maps the segment's increasing record timestamps to offsets.
+	// It shares the index's layout, with each entry's position holding a timestamp in unix nanoseconds.
+	timeIndex *index
+	// maxTimestamp is the latest record timestamp in the segment in unix nanoseconds,
+	// and maxTimestampOffset is the offset of the record which has it.
+	maxTimestamp       int64
+	maxTimestampOffset uint64
+	// timeIndexPos is the store position of the record referenced by the last time index entry.
+	timeIndexPos uint64
+	// compacted is true if records may be missing from the end of the segment, see flagCompacted.
+	compacted bool
+	// continues is true if the segment ends with part of a batch which continues in the next segment,
+	// see attrBatchNextSegment, and partOffset is the offset of the first record of the part.
+	continues  bool
+	partOffset uint64
+	// refs counts the users of the segment: the log while the segment is in it, and the iterators reading it.
+	// The segment's files are closed once it has no users left, see release.
+	refs int32
+	// closed is true once the segment's files are closed.
+	closed bool
 }
 
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	s := &segment{
 		baseOffset: baseOffset,
 		config:     c,
+		refs:       1,
 	}
 	var err error
 
 	// Set up store file.
-	storeFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
-		os.O_RDWR|os.O_CREATE|os.O_APPEND,
-		0644,
+	storeFile, header, err := openSegmentFile(
+		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, storeExt)),
+		storeMagic,
+		baseOffset,
+		os.O_APPEND,
 	)
 	if err != nil {
 		return nil, err
 	}
+	s.compacted = header.flags&flagCompacted != 0
 	s.store, err = newStore(storeFile)
 	if err != nil {
 		return nil, err
 	}
+	s.store.compression = c.Segment.Compression
+	s.store.keyring = c.Encryption.keyring
+	fi, err := storeFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	s.lastWrite = fi.ModTime()
 
 	// Set up index file.
-	indexFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
-		os.O_RDWR|os.O_CREATE,
-		0644,
+	indexFile, _, err := openSegmentFile(
+		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, indexExt)),
+		indexMagic,
+		baseOffset,
+		0,
 	)
 	if err != nil {
 		return nil, err
@@ -53,84 +102,454 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		return nil, err
 	}
 
-	relativeOffset, _, err := s.index.Read(-1)
-	// If there is an error reading the last entry in the index, it means the index file is empty.
-	// Hence, the offset of the next record to be added
-	// is the offset of the first record in the segment, which is `baseOffset`.
+	// Set up time index file.
+	timeIndexFile, _, err := openSegmentFile(
+		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, timeIndexExt)),
+		timeIndexMagic,
+		baseOffset,
+		0,
+	)
 	if err != nil {
-		s.nextOffset = baseOffset
-	} else {
-		// e.g. the segment holds records from offset 10 onwards,
-		// and the index file already references 2 records (`relativeOffset` is 1)
-		// Hence, the offset of the next record to be added to the segment is
-		// 10 + 1 + 1 = 12 (the 13th record).
-		s.nextOffset = baseOffset + uint64(relativeOffset) + 1
+		return nil, err
+	}
+	s.timeIndex, err = newIndex(timeIndexFile, c)
+	if err != nil {
+		return nil, err
+	}
+
+	// Repair the files in case the process crashed while appending to the segment.
+	// This also finds the offset of the next record to be added to the segment,
+	// as the index may not have an entry for the last record.
+	if s.repair, err = s.recover(); err != nil {
+		return nil, err
 	}
 
+	if err = s.loadTimeIndex(); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
-// Append appends the record into the segment and returns the record's offset, and error if any.
-func (s *segment) Append(record *api.Record) (offset uint64, err error) {
-	currOffset := s.nextOffset
-	record.Offset = currOffset
-	p, err := proto.Marshal(record)
-	if err != nil {
-		return 0, err
+// AppendBatch appends as many of the records as fit into the segment, and returns how many were appended.
+// The records are written as a single batch: if the process crashes before the whole batch is written,
+// the batch is discarded when the segment is recovered. If not every record fits, the last entry is marked
+// as continuing in the next segment, so that the log discards the records if the rest of the batch is not written.
+// With Segment.BatchCompression, they are compressed
+// together in a single store entry, with a single index entry.
+// Records without a timestamp are stamped with the time they are appended.
+func (s *segment) AppendBatch(records []*api.Record) (int, error) {
+	now := time.Now()
+	var ps [][]byte
+	storeSize, indexSize := s.store.size, s.index.size
+	together := s.config.Segment.BatchCompression && s.config.Segment.Compression != CompressionNone
+	for _, record := range records {
+		// A sparse index, or a batch compressed together, has at most one entry for the batch.
+		needsEntry := (s.config.Segment.IndexIntervalBytes == 0 && !together) || len(ps) == 0
+		if storeSize >= s.config.Segment.MaxStoreBytes ||
+			(needsEntry && indexSize+indexLenNumBytes > s.config.Segment.MaxIndexBytes) ||
+			s.nextOffset+uint64(len(ps))-s.baseOffset >= maxSegmentOffsets {
+			break
+		}
+		record.Offset = s.nextOffset + uint64(len(ps))
+		if record.Timestamp == nil {
+			record.Timestamp = timestamppb.New(now)
+		}
+		p, err := proto.Marshal(record)
+		if err != nil {
+			return 0, err
+		}
+		ps = append(ps, p)
+		storeSize += uint64(len(p)) + entryHeaderNumBytes
+		if needsEntry {
+			indexSize += indexLenNumBytes
+		}
+	}
+	if len(ps) == 0 {
+		return 0, nil
 	}
 
-	_, pos, err := s.store.Append(p)
-	if err != nil {
+	if err := s.writeBatch(records[:len(ps)], ps, len(ps) < len(records)); err != nil {
 		return 0, err
 	}
+	s.lastWrite = now
+	return len(ps), nil
+}
 
-	// index offsets are relative
-	err = s.index.Write(uint32(s.nextOffset-s.baseOffset), pos)
-	if err != nil {
-		return 0, err
+// AppendAt appends the record at its own offset, which must be at or after the segment's next offset.
+// Restoring a snapshot uses it to write the snapshot's records, leaving gaps at the offsets removed by compaction.
+func (s *segment) AppendAt(record *api.Record) error {
+	return s.AppendBatchAt([]*api.Record{record})
+}
+
+// AppendBatchAt appends the records at their own offsets as a single batch. The offsets must increase,
+// and be at or after the segment's next offset. Compaction uses it to rewrite a segment entry by entry,
+// leaving gaps at the offsets of the records it removed, and keeping the records of a batch compressed together.
+func (s *segment) AppendBatchAt(records []*api.Record) error {
+	if records[len(records)-1].Offset-s.baseOffset >= maxSegmentOffsets {
+		return errSegmentOffsetsFull
+	}
+	ps := make([][]byte, len(records))
+	for i, record := range records {
+		p, err := proto.Marshal(record)
+		if err != nil {
+			return err
+		}
+		ps[i] = p
+	}
+	return s.writeBatch(records, ps, false)
+}
+
+// writeBatch writes the marshalled records to the store as a single batch, and indexes them.
+// With Segment.BatchCompression, they are compressed together in a single store entry, with a single index entry.
+// `continues` marks the batch as continuing in the next segment.
+func (s *segment) writeBatch(records []*api.Record, ps [][]byte, continues bool) error {
+	together := s.config.Segment.BatchCompression && s.config.Segment.Compression != CompressionNone
+	var pos []uint64
+	if together && len(ps) > 1 {
+		_, batchPos, err := s.store.AppendRecordBatch(ps, continues)
+		if err != nil {
+			return err
+		}
+		// Every record is read from the batch's entry.
+		pos = make([]uint64, len(ps))
+		for i := range pos {
+			pos[i] = batchPos
+		}
+	} else {
+		var err error
+		if _, pos, err = s.store.AppendBatch(ps, continues); err != nil {
+			return err
+		}
+	}
+	for i, record := range records {
+		if i == 0 || pos[i] != pos[i-1] {
+			if err := s.writeIndex(record.Offset, pos[i], i == 0); err != nil {
+				return err
+			}
+		}
+		if err := s.indexTime(record, pos[i]); err != nil {
+			return err
+		}
 	}
+	s.nextOffset = records[len(records)-1].Offset + 1
+	s.continues, s.partOffset = continues, records[0].Offset
+	return nil
+}
 
-	s.nextOffset++
-	return currOffset, nil
+// writeIndex adds an index entry for the record with offset `off` at `pos` in the store.
+// In sparse mode, only the first record of a batch is indexed, once `Segment.IndexIntervalBytes`
+// have been appended since the last entry's record. The first record in the segment is always indexed.
+func (s *segment) writeIndex(off, pos uint64, batchStart bool) error {
+	if interval := s.config.Segment.IndexIntervalBytes; interval > 0 && s.index.size > 0 {
+		_, lastPos, err := s.index.Read(-1)
+		if err != nil {
+			return err
+		}
+		if !batchStart || pos < lastPos+interval {
+			return nil
+		}
+	}
+	// index offsets are relative
+	return s.index.Write(uint32(off-s.baseOffset), pos)
 }
 
 // Read takes in a record offset and returns the corresponding record.
+// It returns io.EOF if the segment has no record at the offset.
 func (s *segment) Read(off uint64) (*api.Record, error) {
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	var found *api.Record
+	var corrupt bool
+	err := s.scan(off, func(record *api.Record, _ uint64) (bool, error) {
+		if record == nil {
+			corrupt = true
+			return true, nil
+		}
+		if record.Offset == off {
+			found = record
+		}
+		return false, nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	if found != nil {
+		return found, nil
+	}
+	// The record could not be reached past a corrupt entry.
+	if corrupt {
+		return nil, api.ErrCorruptRecord{Offset: off}
+	}
+	return nil, io.EOF
+}
+
+// Records calls fn with each of the segment's records in offset order, until fn returns an error.
+func (s *segment) Records(fn func(*api.Record) error) error {
+	next := s.baseOffset
+	return s.scan(s.baseOffset, func(record *api.Record, _ uint64) (bool, error) {
+		if record == nil {
+			return false, api.ErrCorruptRecord{Offset: next}
+		}
+		next = record.Offset + 1
+		return true, fn(record)
+	})
+}
+
+// Entries calls fn with the records of each of the segment's store entries in offset order, until fn returns an error.
+// An entry holds several records if its batch was compressed together.
+func (s *segment) Entries(fn func([]*api.Record) error) error {
+	var entry []*api.Record
+	var entryPos uint64
+	next := s.baseOffset
+	err := s.scan(s.baseOffset, func(record *api.Record, pos uint64) (bool, error) {
+		if record == nil {
+			return false, api.ErrCorruptRecord{Offset: next}
+		}
+		next = record.Offset + 1
+		if len(entry) > 0 && pos != entryPos {
+			if err := fn(entry); err != nil {
+				return false, err
+			}
+			entry = nil
+		}
+		entry, entryPos = append(entry, record), pos
+		return true, nil
+	})
+	if err != nil || len(entry) == 0 {
+		return err
+	}
+	return fn(entry)
+}
+
+// readRange returns up to `max` of the segment's records from offset `from` onwards, in offset order.
+func (s *segment) readRange(from uint64, max int) ([]*api.Record, error) {
+	var records []*api.Record
+	next := from
+	err := s.scan(from, func(record *api.Record, _ uint64) (bool, error) {
+		if record == nil {
+			return false, api.ErrCorruptRecord{Offset: next}
+		}
+		records = append(records, record)
+		next = record.Offset + 1
+		return len(records) < max, nil
+	})
+	return records, err
+}
+
+// position returns the first of the segment's records from offset `from` onwards, and its position in the store.
+// It returns io.EOF if the segment has no record from `from` onwards.
+func (s *segment) position(from uint64) (*api.Record, uint64, error) {
+	var found *api.Record
+	var pos uint64
+	err := s.scan(from, func(record *api.Record, entryPos uint64) (bool, error) {
+		if record == nil {
+			return false, api.ErrCorruptRecord{Offset: from}
+		}
+		found, pos = record, entryPos
+		return false, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if found == nil {
+		return nil, 0, io.EOF
+	}
+	return found, pos, nil
+}
 
-	p, err := s.store.Read(pos)
+// readRaw returns the store entries of the segment's records from offset `from` onwards as they are in the store,
+// up to `maxBytes` bytes but at least one entry, and the offset after the last record returned.
+// Only the first and the last entry are decoded. The chunk ends before the first corrupt entry.
+// It returns io.EOF if the segment has no record from `from` onwards.
+func (s *segment) readRaw(from, maxBytes uint64) ([]byte, uint64, error) {
+	first, start, err := s.position(from)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	end := start
+	for {
+		n, err := s.store.EntryLen(end)
+		if err == io.EOF || err == errCorruptEntry {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if end > start && end+n-start > maxBytes {
+			break
+		}
+		end += n
+	}
+	b := make([]byte, end-start)
+	if _, err = s.store.ReadAt(b, int64(start)); err != nil {
+		return nil, 0, err
+	}
+	// Verify the entries, and find the first and the last one.
+	var firstEntry, last rawEntry
+	for i := uint64(0); i < uint64(len(b)); i += last.len {
+		entry, err := parseRawEntry(b[i:])
+		if err != nil {
+			b = b[:i]
+			break
+		}
+		if i == 0 {
+			firstEntry = entry
+		}
+		last = entry
+	}
+	if firstEntry.len == 0 {
+		return nil, 0, api.ErrCorruptRecord{Offset: first.Offset}
+	}
+	records, err := last.records(s.store.keyring)
+	if err != nil {
+		// The offset after the last record is unknown, so only the first entry is returned.
+		// Its records were read to find the first record, so they decode.
+		b = b[:firstEntry.len]
+		if records, err = firstEntry.records(s.store.keyring); err != nil {
+			return nil, 0, err
+		}
 	}
-	record := &api.Record{}
-	err = proto.Unmarshal(p, record)
-	return record, err
+	return b, records[len(records)-1].Offset + 1, nil
+}
+
+// scan calls fn with each of the segment's records from offset `from` onwards in offset order,
+// along with the position in the store of the entry holding the record, until fn returns false or an error.
+// It starts from the last index entry at or before `from` and reads the store forward,
+// as a sparse index does not have an entry for every record.
+// fn is called with a nil record for a corrupt entry, and the scan continues from the next index entry,
+// as the length of a corrupt entry cannot be trusted.
+func (s *segment) scan(from uint64, fn func(record *api.Record, pos uint64) (bool, error)) error {
+	var rel uint32
+	if from > s.baseOffset {
+		if from-s.baseOffset > math.MaxUint32 {
+			return nil
+		}
+		rel = uint32(from - s.baseOffset)
+	}
+	j, err := s.index.Floor(rel)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, pos, err := s.index.Read(j)
+	if err != nil {
+		return err
+	}
+	for pos < s.store.size {
+		records, entryLen, _, err := s.entryRecords(pos)
+		if err == errCorruptEntry {
+			if more, err := fn(nil, pos); err != nil || !more {
+				return err
+			}
+			_, pos, err = s.index.Read(s.index.SearchPos(pos + 1))
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if record.Offset < from {
+				continue
+			}
+			if more, err := fn(record, pos); err != nil || !more {
+				return err
+			}
+		}
+		pos += entryLen
+	}
+	return nil
 }
 
+// IsMaxed returns true if the store has reached its max size, the index has no space for another entry,
+// or the segment has no offset left for another record.
 func (s *segment) IsMaxed() bool {
 	return s.store.size >= s.config.Segment.MaxStoreBytes ||
-		s.index.size >= s.config.Segment.MaxIndexBytes
+		s.index.size+indexLenNumBytes > s.config.Segment.MaxIndexBytes ||
+		s.nextOffset-s.baseOffset >= maxSegmentOffsets
 }
 
-// Remove closes and removes the segment's store and index files.
-func (s *segment) Remove() error {
-	if err := s.Close(); err != nil {
+// Truncate removes the records from offset `off` onwards from the segment.
+// The entry of a batch compressed together is removed in full, so `off` must not be in the middle of one.
+func (s *segment) Truncate(off uint64) error {
+	if off >= s.nextOffset {
+		return nil
+	}
+	pos := s.store.size
+	err := s.scan(off, func(record *api.Record, recordPos uint64) (bool, error) {
+		if record == nil {
+			return true, nil
+		}
+		pos = recordPos
+		return false, nil
+	})
+	if err != nil {
 		return err
 	}
+	if err = s.store.Truncate(pos); err != nil {
+		return err
+	}
+	s.index.Truncate(uint64(s.index.SearchPos(pos)))
+	s.nextOffset = off
+	if s.partOffset >= off {
+		s.continues = false
+	}
+	return s.loadTimeIndex()
+}
+
+// Remove removes the segment's store and index files, and releases the caller's reference to the segment.
+// Iterators still reading the segment keep reading the removed files until they release it.
+func (s *segment) Remove() error {
 	if err := os.Remove(s.index.Name()); err != nil {
 		return err
 	}
+	if err := os.Remove(s.timeIndex.Name()); err != nil {
+		return err
+	}
 	if err := os.Remove(s.store.Name()); err != nil {
 		return err
 	}
+	return s.release()
+}
+
+// acquire adds a reference to the segment, which keeps its files open until it is released.
+// The caller must hold the log's lock, so that the segment is not released by the log in the meantime.
+func (s *segment) acquire() {
+	atomic.AddInt32(&s.refs, 1)
+}
+
+// release drops a reference to the segment, and closes the segment once no reference is left.
+func (s *segment) release() error {
+	if atomic.AddInt32(&s.refs, -1) == 0 {
+		return s.Close()
+	}
 	return nil
 }
 
-// Close closes the segment's store and index files.
+// Sync commits the segment's records to disk.
+// Only the store is synced, as missing index entries are recovered from the store when the segment is opened.
+func (s *segment) Sync() error {
+	return s.store.Sync()
+}
+
+// Close closes the segment's store and index files, even if iterators are still reading the segment.
+// Closing a closed segment does nothing.
 func (s *segment) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if err := s.sealTimeIndex(); err != nil {
+		return err
+	}
+	if err := s.timeIndex.Close(); err != nil {
+		return err
+	}
 	if err := s.index.Close(); err != nil {
 		return err
 	}
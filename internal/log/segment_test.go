@@ -5,6 +5,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"testing"
 )
@@ -26,8 +27,7 @@ func TestSegment(t *testing.T) {
 	require.False(t, s.IsMaxed())
 
 	for i := 0; i < 3; i++ {
-		off, err := s.Append(want)
-		require.NoError(t, err)
+		off := appendRecord(t, s, want)
 		require.Equal(t, uint64(16+i), off)
 
 		got, err := s.Read(off)
@@ -35,9 +35,12 @@ func TestSegment(t *testing.T) {
 		require.Equal(t, want.Value, got.Value)
 	}
 
-	_, err = s.Append(want)
-	require.Equal(t, io.EOF, err)
+	// The index is full.
+	n, err := s.AppendBatch([]*api.Record{want})
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
 	require.True(t, s.IsMaxed())
+	require.NoError(t, s.Close())
 
 	c.Segment.MaxStoreBytes = uint64(len(want.Value) * 3)
 	c.Segment.MaxIndexBytes = 1024
@@ -52,3 +55,133 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
 }
+
+func TestSegmentAppendBatch(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment_append_batch_test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = indexLenNumBytes * 3
+	c.Segment.MaxStoreBytes = 1024
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+
+	var batch []*api.Record
+	for i := 0; i < 5; i++ {
+		batch = append(batch, &api.Record{Value: []byte("hello world")})
+	}
+	// Only three records fit into the index.
+	n, err := s.AppendBatch(batch)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	require.True(t, s.IsMaxed())
+	for i := 0; i < n; i++ {
+		got, err := s.Read(uint64(16 + i))
+		require.NoError(t, err)
+		require.Equal(t, uint64(16+i), got.Offset)
+	}
+
+	n, err = s.AppendBatch(batch[n:])
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	// Truncate removes the records from the offset onwards.
+	require.NoError(t, s.Truncate(17))
+	require.Equal(t, uint64(17), s.nextOffset)
+	require.False(t, s.IsMaxed())
+	_, err = s.Read(17)
+	require.Equal(t, io.EOF, err)
+}
+
+func TestSegmentSparseIndex(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment_sparse_index_test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	// The index only has room for three entries, but the segment holds more records.
+	c.Segment.MaxIndexBytes = 3 * indexLenNumBytes
+	c.Segment.IndexIntervalBytes = 200
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	for !s.IsMaxed() {
+		appendRecord(t, s, &api.Record{Value: []byte("hello world")})
+	}
+	records := s.nextOffset - 16
+	require.Greater(t, records, uint64(3))
+
+	requireRecords := func(s *segment) {
+		t.Helper()
+		require.Equal(t, 16+records, s.nextOffset)
+		for off := uint64(16); off < s.nextOffset; off++ {
+			got, err := s.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, off, got.Offset)
+		}
+		_, err = s.Read(s.nextOffset)
+		require.Equal(t, io.EOF, err)
+	}
+	requireRecords(s)
+
+	// The next offset is found by scanning the store past the last index entry.
+	require.NoError(t, s.Close())
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Nil(t, s.repair)
+	requireRecords(s)
+
+	// Truncating between index entries keeps the entries before the truncated records.
+	require.NoError(t, s.Truncate(16+records-1))
+	records--
+	requireRecords(s)
+	require.NoError(t, s.Remove())
+}
+
+func TestSegmentOffsetBoundary(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment_offset_boundary_test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.MaxStoreBytes = 1024
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+
+	// The last offset the segment can hold is written with a gap before it, as compaction leaves them.
+	last := uint64(16 + math.MaxUint32)
+	require.NoError(t, s.AppendAt(&api.Record{Offset: last - 1, Value: []byte("hello world")}))
+	require.False(t, s.IsMaxed())
+	off := appendRecord(t, s, &api.Record{Value: []byte("hello world")})
+	require.Equal(t, last, off)
+	require.True(t, s.IsMaxed())
+
+	// No record is appended past the last offset, so relative offsets do not wrap around.
+	n, err := s.AppendBatch([]*api.Record{{Value: []byte("hello world")}})
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	require.Equal(t, errSegmentOffsetsFull, s.AppendAt(&api.Record{Offset: last + 1}))
+	require.NoError(t, s.Close())
+
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Nil(t, s.repair)
+	require.Equal(t, last+1, s.nextOffset)
+	for _, off := range []uint64{last - 1, last} {
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, got.Offset)
+	}
+	_, err = s.Read(16)
+	require.Equal(t, io.EOF, err)
+}
+
+// appendRecord appends the record to the segment on its own, and returns its offset.
+func appendRecord(t *testing.T, s *segment, record *api.Record) uint64 {
+	t.Helper()
+	n, err := s.AppendBatch([]*api.Record{record})
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	return record.Offset
+}
@@ -0,0 +1,314 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrCorruptSnapshot is returned when a snapshot ends in the middle of an entry,
+// or one of its entries fails its integrity check.
+var ErrCorruptSnapshot = errors.New("corrupt snapshot")
+
+// NewLogFromSnapshot creates a log in `dir` holding the records of a snapshot read from `r`,
+// i.e. of the entries of a log's stores as they are returned by Log.Reader. See Log.Restore.
+// It refuses a directory which already holds a log. If the snapshot cannot be restored,
+// the files created in the directory are removed, so that the restore can be retried.
+func NewLogFromSnapshot(dir string, c Config, r io.Reader) (*Log, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	segments, err := scanDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		return nil, fmt.Errorf("restore snapshot: %s already holds a log", dir)
+	}
+	existing, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	l, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	if err = l.Restore(r); err != nil {
+		l.Close()
+		removeCreatedFiles(dir, existing)
+		return nil, err
+	}
+	return l, nil
+}
+
+// removeCreatedFiles removes the files in `dir` which are not among the `existing` files.
+// It is best effort, as it cleans up after a failure which is reported instead.
+func removeCreatedFiles(dir string, existing []os.FileInfo) {
+	keep := make(map[string]bool)
+	for _, file := range existing {
+		keep[file.Name()] = true
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if !keep[file.Name()] {
+			os.RemoveAll(path.Join(dir, file.Name()))
+		}
+	}
+}
+
+// Restore replaces the log's records with the records of a snapshot read from `r`, see Log.Reader.
+// The records keep their offsets, including the gaps left by compaction, and are written to new segments
+// as the log is configured, i.e. segments are as large as `Config.Segment` allows, and the records are
+// compressed and encrypted with the log's codec and key. Encrypted records in the snapshot are decrypted
+// with the log's key file. Each segment keeps the age of its latest record for the retention policy.
+//
+// The snapshot is written in full before the log's segments are replaced, so the log is left as it was
+// if the snapshot cannot be read. Once it is written, the restored segments replace the log's segments
+// even if the process crashes, as opening the log finishes the restore. If they cannot be opened,
+// the log keeps its segments until it is opened or restored again.
+// Iterators and readers keep reading the replaced segments.
+// The restored log starts at the snapshot's first record, so the offsets before it which were removed
+// by compaction read as truncated. The offset the next appended record gets follows the snapshot's last record.
+func (l *Log) Restore(r io.Reader) error {
+	l.rewriteMu.Lock()
+	defer l.rewriteMu.Unlock()
+	// A restore whose segments could not be opened is finished first, so that it is not finished over this one.
+	if _, err := os.Stat(path.Join(l.Dir, restoreDir)); err == nil {
+		if err = l.reopenRestored(); err != nil {
+			return err
+		}
+	}
+	dir, err := l.makeRewriteDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err = l.writeSnapshot(dir, r); err != nil {
+		return err
+	}
+	if err = stageRestore(l.Dir, dir); err != nil {
+		return err
+	}
+	return l.reopenRestored()
+}
+
+// reopenRestored finishes the restore in the log's restore directory, and replaces the log's segments
+// with the restored segments. The log keeps its segments if the restored segments cannot be opened.
+func (l *Log) reopenRestored() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	segments, activeSegment, repairs := l.segments, l.activeSegment, l.repairs
+	l.segments, l.activeSegment, l.repairs = nil, nil, nil
+	if err := l.openSegments(); err != nil {
+		l.segments, l.activeSegment, l.repairs = segments, activeSegment, repairs
+		return err
+	}
+	// The replaced segments' files were removed or replaced by the restore, so they are only closed.
+	var err error
+	for _, s := range segments {
+		if releaseErr := s.release(); err == nil {
+			err = releaseErr
+		}
+	}
+	l.unsynced, l.syncErr = 0, nil
+	if l.cache != nil {
+		l.cache.remove(0, math.MaxUint64)
+	}
+	return err
+}
+
+// restoreDir is the directory in the log's directory holding the segments of a restore
+// until they replace the log's segments, see finishRestore.
+const restoreDir = "restore"
+
+// restoreManifest is the file in the restore directory listing the names of the restored segments' files.
+const restoreManifest = "MANIFEST"
+
+// stageRestore moves the restored segments written to `dir` to the restore directory of the log in `logDir`.
+// The directory is renamed only once it lists the restored files, so the log is either restored in full
+// once the restore directory exists, or left as it was.
+func stageRestore(logDir, dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var manifest bytes.Buffer
+	for _, file := range files {
+		fmt.Fprintln(&manifest, file.Name())
+	}
+	if err = writeFileSync(path.Join(dir, restoreManifest), manifest.Bytes()); err != nil {
+		return err
+	}
+	if err = os.Rename(dir, path.Join(logDir, restoreDir)); err != nil {
+		return err
+	}
+	return syncDir(logDir)
+}
+
+// finishRestore replaces the segments in `logDir` with the segments in its restore directory, if there is one.
+// Each step can be repeated, so a restore interrupted by a crash is finished when the log is opened again:
+// the segment files which are not restored are removed, the restored files are moved into the log's directory,
+// and the restore directory is removed once they are all in place.
+func finishRestore(logDir string) error {
+	dir := path.Join(logDir, restoreDir)
+	b, err := ioutil.ReadFile(path.Join(dir, restoreManifest))
+	if os.IsNotExist(err) {
+		// Only the empty directory is left of a finished restore, if anything.
+		return os.RemoveAll(dir)
+	}
+	if err != nil {
+		return err
+	}
+	restored := make(map[string]bool)
+	for _, name := range strings.Fields(string(b)) {
+		restored[name] = true
+	}
+	files, err := ioutil.ReadDir(logDir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if _, _, ok := parseSegmentFileName(file.Name()); ok && !file.IsDir() && !restored[file.Name()] {
+			if err = os.Remove(path.Join(logDir, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	// The files still in the restore directory are the ones which have yet to be moved.
+	if files, err = ioutil.ReadDir(dir); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.Name() == restoreManifest {
+			continue
+		}
+		if err = os.Rename(path.Join(dir, file.Name()), path.Join(logDir, file.Name())); err != nil {
+			return err
+		}
+	}
+	if err = syncDir(logDir); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// writeSnapshot writes the records of the snapshot read from `r` to segments in `dir`,
+// starting a new segment whenever a segment is maxed.
+func (l *Log) writeSnapshot(dir string, r io.Reader) (err error) {
+	br := bufio.NewReader(r)
+	var s *segment
+	// latest is the latest timestamp of the records in s.
+	var latest time.Time
+	defer func() {
+		if s != nil && err != nil {
+			s.Close()
+		}
+	}()
+	var pos uint64
+	for {
+		entry, err := readSnapshotEntry(br)
+		if err == io.EOF {
+			break
+		}
+		if err == errCorruptEntry {
+			return fmt.Errorf("%w: entry at byte %d", ErrCorruptSnapshot, pos)
+		}
+		if err != nil {
+			return err
+		}
+		records, err := entry.records(l.Encryption.keyring)
+		if err == errCorruptEntry {
+			return fmt.Errorf("%w: entry at byte %d", ErrCorruptSnapshot, pos)
+		}
+		if err != nil {
+			return fmt.Errorf("restore snapshot: entry at byte %d: %w", pos, err)
+		}
+		for _, record := range records {
+			if s != nil && record.Offset < s.nextOffset {
+				return fmt.Errorf("%w: entry at byte %d has offset %d, after offset %d",
+					ErrCorruptSnapshot, pos, record.Offset, s.nextOffset-1)
+			}
+			if s != nil && (s.IsMaxed() || record.Offset-s.baseOffset >= maxSegmentOffsets) {
+				// The segment's next offsets were removed by compaction if the record does not follow it.
+				err = finishSnapshotSegment(s, record.Offset > s.nextOffset, latest)
+				s, latest = nil, time.Time{}
+				if err != nil {
+					return err
+				}
+			}
+			if s == nil {
+				if s, err = newSegment(dir, record.Offset, l.Config); err != nil {
+					return err
+				}
+			}
+			if err = s.AppendAt(record); err != nil {
+				return err
+			}
+			if record.Timestamp != nil && record.Timestamp.AsTime().After(latest) {
+				latest = record.Timestamp.AsTime()
+			}
+		}
+		pos += entry.len
+	}
+	if s == nil {
+		return nil
+	}
+	err = finishSnapshotSegment(s, false, latest)
+	s = nil
+	return err
+}
+
+// finishSnapshotSegment syncs and closes a segment written from a snapshot,
+// and marks it as compacted if records are missing from its end.
+// The segment was last written to at the time of its latest record, if it is known.
+func finishSnapshotSegment(s *segment, compacted bool, lastWrite time.Time) error {
+	err := s.Sync()
+	if closeErr := s.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && compacted {
+		err = setFileHeaderFlags(s.store.Name(), flagCompacted)
+	}
+	if err == nil && !lastWrite.IsZero() {
+		err = os.Chtimes(s.store.Name(), time.Now(), lastWrite)
+	}
+	return err
+}
+
+// readSnapshotEntry reads and verifies the next entry of a snapshot.
+// It returns io.EOF if the snapshot has no more entries,
+// and errCorruptEntry if the snapshot ends in the middle of the entry or the entry fails its integrity check.
+func readSnapshotEntry(r io.Reader) (rawEntry, error) {
+	lenBytes := make([]byte, recordLenNumBytes)
+	if _, err := io.ReadFull(r, lenBytes); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return rawEntry{}, errCorruptEntry
+		}
+		return rawEntry{}, err
+	}
+	_, size, headerLen, err := parseEntryHeader(lenBytes, true)
+	if err != nil {
+		return rawEntry{}, err
+	}
+	// The entry is read as it arrives, so that a corrupt length does not allocate the length up front.
+	var b bytes.Buffer
+	b.Write(lenBytes)
+	if _, err = io.CopyN(&b, r, int64(headerLen-recordLenNumBytes+size)); err != nil {
+		if err == io.EOF {
+			return rawEntry{}, errCorruptEntry
+		}
+		return rawEntry{}, err
+	}
+	return parseRawEntry(b.Bytes())
+}
@@ -0,0 +1,214 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	api "github.com/jxofficial/log/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, log *Log, dir string){
+		"snapshot is restored into a new log":            testNewLogFromSnapshot,
+		"restore replaces the log's records":             testRestore,
+		"corrupt snapshot leaves the log as it was":      testRestoreCorrupt,
+		"interrupted restore is finished on setup":       testRestoreInterrupted,
+		"failed restore keeps the log's segments":        testRestoreOpenFails,
+		"new log from snapshot refuses an existing log":  testNewLogFromSnapshotExisting,
+		"new log from a corrupt snapshot can be retried": testNewLogFromSnapshotRetry,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "snapshot_test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			// Each segment holds three records, so the log has the segments [0, 3), [3, 6) and [6, 9).
+			c.Segment.MaxIndexBytes = 3 * indexLenNumBytes
+			require.NoError(t, os.Mkdir(path.Join(dir, "log"), 0755))
+			log, err := NewLog(path.Join(dir, "log"), c)
+			require.NoError(t, err)
+			defer log.Close()
+			// Compaction keeps records 2, 5, 6 and 7, the latest records of keys c, d, a and b.
+			for i, key := range []string{"a", "b", "c", "a", "b", "d", "a", "b"} {
+				_, err := log.Append(&api.Record{Key: []byte(key), Value: []byte(fmt.Sprintf("record %d", i))})
+				require.NoError(t, err)
+			}
+			require.NoError(t, log.Compact())
+			fn(t, log, dir)
+		})
+	}
+}
+
+// snapshot returns a snapshot of the log.
+func snapshot(t *testing.T, log *Log) []byte {
+	t.Helper()
+	reader := log.Reader()
+	defer reader.Close()
+	b, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	return b
+}
+
+// requireSnapshotRecords checks that the log holds the records kept by compaction, with their offsets.
+func requireSnapshotRecords(t *testing.T, log *Log) {
+	t.Helper()
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	records, err := log.ReadRange(lowest, 0, 0)
+	require.NoError(t, err)
+	requireOffsets(t, records, 2, 5, 6, 7)
+	for _, off := range []uint64{3, 4} {
+		_, err := log.Read(off)
+		require.Equal(t, api.ErrOffsetCompacted{Offset: off}, err)
+	}
+}
+
+func testNewLogFromSnapshot(t *testing.T, log *Log, dir string) {
+	// The restored log has a record per segment, so segment 2 misses offsets 3 and 4 at its end.
+	c := Config{}
+	c.Segment.MaxIndexBytes = indexLenNumBytes
+	c.Segment.Compression = CompressionSnappy
+	restored, err := NewLogFromSnapshot(path.Join(dir, "restored"), c, bytes.NewReader(snapshot(t, log)))
+	require.NoError(t, err)
+	requireSnapshotRecords(t, restored)
+	// The restored log starts at its first record.
+	_, err = restored.Read(1)
+	require.Equal(t, api.ErrOffsetTruncated{Offset: 1, LowestOffset: 2}, err)
+	require.Len(t, restored.segments, 4)
+	require.True(t, restored.segments[0].compacted)
+	require.Equal(t, uint64(5), restored.segments[1].baseOffset)
+
+	// The restored log continues from the snapshot's last record, and survives reopening.
+	off, err := restored.Append(&api.Record{Value: []byte("record 8")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), off)
+	require.NoError(t, restored.Close())
+	restored, err = NewLog(path.Join(dir, "restored"), c)
+	require.NoError(t, err)
+	defer restored.Close()
+	require.Empty(t, restored.Repairs())
+	records, err := restored.ReadRange(5, 0, 0)
+	require.NoError(t, err)
+	requireOffsets(t, records, 5, 6, 7, 8)
+}
+
+func testRestore(t *testing.T, log *Log, dir string) {
+	b := snapshot(t, log)
+	it, err := log.Iterator(0)
+	require.NoError(t, err)
+	defer it.Close()
+
+	// The log's records are replaced by the records of another log.
+	require.NoError(t, log.Restore(bytes.NewReader(otherSnapshot(t, dir))))
+	records, err := log.ReadRange(0, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	require.Equal(t, "hello world", string(records[0].Value))
+	_, err = log.Read(3)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 3}, err)
+
+	// The iterator keeps reading the replaced records.
+	requireOffsets(t, iterate(t, it), 2, 5, 6, 7)
+
+	require.NoError(t, log.Restore(bytes.NewReader(b)))
+	requireSnapshotRecords(t, log)
+}
+
+func testRestoreCorrupt(t *testing.T, log *Log, dir string) {
+	b := snapshot(t, log)
+	for name, corrupt := range map[string][]byte{
+		"truncated": b[:len(b)-1],
+		"flipped":   append(append([]byte(nil), b[:len(b)-1]...), b[len(b)-1]^0xff),
+		"reordered": append(append([]byte(nil), b...), b...),
+	} {
+		err := log.Restore(bytes.NewReader(corrupt))
+		require.True(t, errors.Is(err, ErrCorruptSnapshot), name)
+		requireSnapshotRecords(t, log)
+	}
+	_, err := os.Stat(path.Join(log.Dir, rewriteDir))
+	require.True(t, os.IsNotExist(err))
+}
+
+// otherSnapshot returns a snapshot of a log holding three records.
+func otherSnapshot(t *testing.T, dir string) []byte {
+	t.Helper()
+	require.NoError(t, os.Mkdir(path.Join(dir, "other"), 0755))
+	other, err := NewLog(path.Join(dir, "other"), Config{})
+	require.NoError(t, err)
+	defer other.Close()
+	appendRecords(t, other, 3)
+	return snapshot(t, other)
+}
+
+func testRestoreInterrupted(t *testing.T, log *Log, dir string) {
+	staged, err := log.makeRewriteDir()
+	require.NoError(t, err)
+	require.NoError(t, log.writeSnapshot(staged, bytes.NewReader(otherSnapshot(t, dir))))
+	require.NoError(t, stageRestore(log.Dir, staged))
+	// The process crashes once the log's store of segment 3 is removed and the restored store is moved in.
+	require.NoError(t, os.Remove(path.Join(log.Dir, "3"+storeExt)))
+	restored := path.Join(log.Dir, restoreDir, "0"+storeExt)
+	require.NoError(t, os.Rename(restored, path.Join(log.Dir, "0"+storeExt)))
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer log.Close()
+	records, err := log.ReadRange(0, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	require.Len(t, log.segments, 1)
+	_, err = os.Stat(path.Join(log.Dir, restoreDir))
+	require.True(t, os.IsNotExist(err))
+}
+
+func testRestoreOpenFails(t *testing.T, log *Log, dir string) {
+	// The restored segments overlap, so they cannot be opened.
+	b := otherSnapshot(t, dir)
+	staged := path.Join(dir, "staged")
+	require.NoError(t, os.Mkdir(staged, 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(staged, "0"+storeExt), b, 0644))
+	require.NoError(t, ioutil.WriteFile(path.Join(staged, "1"+storeExt), b, 0644))
+	require.NoError(t, stageRestore(log.Dir, staged))
+
+	var dirErr *DirError
+	require.True(t, errors.As(log.Restore(bytes.NewReader(b)), &dirErr))
+	requireSnapshotRecords(t, log)
+	off, err := log.Append(&api.Record{Value: []byte("record 8")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), off)
+
+	// Removing the overlapping store lets the restore finish.
+	require.NoError(t, os.Remove(path.Join(log.Dir, "1"+storeExt)))
+	require.NoError(t, log.Restore(bytes.NewReader(b)))
+	records, err := log.ReadRange(0, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+}
+
+func testNewLogFromSnapshotRetry(t *testing.T, log *Log, dir string) {
+	b := snapshot(t, log)
+	restoredDir := path.Join(dir, "restored")
+	_, err := NewLogFromSnapshot(restoredDir, log.Config, bytes.NewReader(b[:len(b)-1]))
+	require.True(t, errors.Is(err, ErrCorruptSnapshot))
+	files, err := ioutil.ReadDir(restoredDir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+
+	restored, err := NewLogFromSnapshot(restoredDir, log.Config, bytes.NewReader(b))
+	require.NoError(t, err)
+	defer restored.Close()
+	requireSnapshotRecords(t, restored)
+}
+
+func testNewLogFromSnapshotExisting(t *testing.T, log *Log, dir string) {
+	_, err := NewLogFromSnapshot(log.Dir, log.Config, bytes.NewReader(snapshot(t, log)))
+	require.Error(t, err)
+}
@@ -1,25 +1,78 @@
 package log
 
 import (
-	"bufio"
 	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 )
 
 var (
 	enc = binary.BigEndian
+	// crcTable is used to checksum store entries.
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+	// errCorruptEntry is returned when a store entry fails its integrity check.
+	errCorruptEntry = errors.New("corrupt store entry")
+	// errStoreSealed is returned when appending to a sealed store.
+	errStoreSealed = errors.New("append to sealed store")
 )
 
 const (
 	recordLenNumBytes = 8
+	checksumNumBytes  = 4
+	// entryHeaderNumBytes is the number of bytes written before the record data of each entry.
+	entryHeaderNumBytes = recordLenNumBytes + checksumNumBytes
+
+	// The most significant byte of the length prefix holds the entry's attributes,
+	// and the remaining 56 bits hold the length of the record data.
+	entryAttrShift        = 56
+	entryLenMask   uint64 = 1<<entryAttrShift - 1
+
+	// attrChecksum marks an entry whose length prefix is followed by a CRC32 checksum
+	// of the length prefix and the record data.
+	// Entries written before checksums were introduced have no attributes set, and are read unverified.
+	// They are only found in stores upgraded from files without a header, see flagLegacyEntries.
+	attrChecksum byte = 0x80
+	// attrBatchCont marks an entry which is followed by more entries of the same batch.
+	// The last entry of a batch, and an entry appended on its own, do not have it set.
+	attrBatchCont byte = 0x40
+	// attrBatchNextSegment marks the last entry of a segment's part of a batch which continues in the next segment.
+	// The log discards the part when it is opened if the rest of the batch is missing, see Log.dropTornBatch.
+	attrBatchNextSegment byte = 0x10
+	// attrRecordBatch marks an entry whose record data holds the records of a batch, so that they are compressed
+	// together, see Segment.BatchCompression. Each record is prefixed with its marshalled length as a uvarint.
+	attrRecordBatch byte = 0x20
+	// attrEncrypted marks an entry whose record data is encrypted, see Keyring.
+	// Record data is compressed before it is encrypted.
+	attrEncrypted byte = 0x08
+	// attrCompression holds the Compression codec of the entry's record data.
+	attrCompression byte = 0x07
+	// knownAttrs are the attributes this version of the store understands.
+	knownAttrs = attrChecksum | attrBatchCont | attrBatchNextSegment | attrRecordBatch | attrEncrypted | attrCompression
 )
 
 type store struct {
 	*os.File
-	mu   sync.Mutex
-	buf  *bufio.Writer
+	mu sync.Mutex
+	// buf holds the latest entries until they are written to the file.
+	// Reads of the latest entries are served from it, so reading does not flush it.
+	buf *tailBuffer
+	// size is the number of bytes of entries in the store, after the file header.
 	size uint64
+	// headerSize is the size of the file header. Positions in the store are relative to the end of the header.
+	headerSize uint64
+	// compression is the codec new entries are compressed with.
+	compression Compression
+	// keyring holds the keys to decrypt encrypted entries with, and to encrypt new entries with if it is not nil.
+	keyring *Keyring
+	// legacy is true if the store may hold entries without attributes, see flagLegacyEntries.
+	legacy bool
+	// sealed is non-zero once the store's segment is no longer the active segment.
+	// A sealed store is not appended to and its buffer is empty, so it is read without taking the lock.
+	sealed uint32
 }
 
 func newStore(f *os.File) (*store, error) {
@@ -27,11 +80,21 @@ func newStore(f *os.File) (*store, error) {
 	if err != nil {
 		return nil, err
 	}
-	size := uint64(fi.Size())
+	h, err := readFileHeader(f, storeMagic)
+	if err != nil {
+		return nil, err
+	}
+	// A store without a header predates checksums.
+	headerSize, legacy := uint64(0), true
+	if h != nil {
+		headerSize, legacy = fileHeaderNumBytes, h.flags&flagLegacyEntries != 0
+	}
 	return &store{
-		File: f,
-		size: size,
-		buf:  bufio.NewWriter(f),
+		File:       f,
+		size:       uint64(fi.Size()) - headerSize,
+		headerSize: headerSize,
+		legacy:     legacy,
+		buf:        newTailBuffer(f),
 	}, nil
 }
 
@@ -40,51 +103,351 @@ func newStore(f *os.File) (*store, error) {
 func (s *store) Append(p []byte) (n, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.isSealed() {
+		return 0, 0, errStoreSealed
+	}
 	pos = s.size
-	// Write the length of the record (represented in big endian encoding)
-	// into the store's buffered writer.
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
+	if err := s.appendEntry(p, attrChecksum); err != nil {
 		return 0, 0, err
 	}
-	numBytesWritten, err := s.buf.Write(p)
-	if err != nil {
+	return s.size - pos, pos, nil
+}
+
+// AppendBatch appends the record data of a batch of records into the store as consecutive entries,
+// marking every entry but the last with attrBatchCont, and the last with attrBatchNextSegment if the batch
+// `continues` in the next segment. It returns the number of bytes written,
+// and the starting byte position of each record entry in the store. It also returns an error if any.
+func (s *store) AppendBatch(ps [][]byte, continues bool) (n uint64, pos []uint64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isSealed() {
+		return 0, nil, errStoreSealed
+	}
+	start := s.size
+	pos = make([]uint64, len(ps))
+	for i, p := range ps {
+		pos[i] = s.size
+		attrs := attrChecksum
+		if i < len(ps)-1 {
+			attrs |= attrBatchCont
+		} else if continues {
+			attrs |= attrBatchNextSegment
+		}
+		if err := s.appendEntry(p, attrs); err != nil {
+			return 0, nil, err
+		}
+	}
+	return s.size - start, pos, nil
+}
+
+// AppendRecordBatch appends the record data of a batch of records into the store as a single entry,
+// see attrRecordBatch, which is marked with attrBatchNextSegment if the batch `continues` in the next segment.
+// It returns the number of bytes written, and the starting byte position of the entry.
+func (s *store) AppendRecordBatch(ps [][]byte, continues bool) (n, pos uint64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isSealed() {
+		return 0, 0, errStoreSealed
+	}
+	var b []byte
+	lenBytes := make([]byte, binary.MaxVarintLen64)
+	for _, p := range ps {
+		b = append(b, lenBytes[:binary.PutUvarint(lenBytes, uint64(len(p)))]...)
+		b = append(b, p...)
+	}
+	attrs := attrChecksum | attrRecordBatch
+	if continues {
+		attrs |= attrBatchNextSegment
+	}
+	pos = s.size
+	if err := s.appendEntry(b, attrs); err != nil {
 		return 0, 0, err
 	}
+	return s.size - pos, pos, nil
+}
 
-	numBytesWritten += recordLenNumBytes
-	s.size += uint64(numBytesWritten)
-	return uint64(numBytesWritten), pos, nil
+// appendEntry writes an entry holding the record data (p) with the given attributes into the store's buffered writer.
+// The record data is compressed with the store's codec, unless that does not make it smaller.
+// The caller must hold the lock.
+func (s *store) appendEntry(p []byte, attrs byte) error {
+	if s.compression != CompressionNone {
+		compressed, err := s.compression.compress(p)
+		if err != nil {
+			return err
+		}
+		if len(compressed) < len(p) {
+			p = compressed
+			attrs |= byte(s.compression)
+		}
+	}
+	if s.keyring != nil {
+		encrypted, err := s.keyring.encrypt(p)
+		if err != nil {
+			return err
+		}
+		p = encrypted
+		attrs |= attrEncrypted
+	}
+	// Write the attributes and length of the record (represented in big endian encoding),
+	// followed by the checksum, into the store's buffered writer.
+	header := make([]byte, entryHeaderNumBytes)
+	enc.PutUint64(header[:recordLenNumBytes], uint64(attrs)<<entryAttrShift|uint64(len(p)))
+	enc.PutUint32(header[recordLenNumBytes:], checksum(header[:recordLenNumBytes], p))
+	if _, err := s.buf.Write(header); err != nil {
+		return err
+	}
+	numBytesWritten, err := s.buf.Write(p)
+	if err != nil {
+		return err
+	}
+	s.size += uint64(numBytesWritten + entryHeaderNumBytes)
+	return nil
 }
 
 // Read returns the record data at the specified position.
+// It returns errCorruptEntry if the entry fails its integrity check.
 func (s *store) Read(pos uint64) ([]byte, error) {
+	if s.isSealed() {
+		b, _, _, err := s.readEntry(pos)
+		return b, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, _, _, err := s.readEntry(pos)
+	return b, err
+}
+
+// Entry verifies the entry at the specified position and returns its record data,
+// its length in bytes including the length prefix and checksum, and its attributes.
+// It returns io.EOF if pos is at or past the end of the store,
+// and errCorruptEntry if the entry is partially written or fails its integrity check.
+func (s *store) Entry(pos uint64) ([]byte, uint64, byte, error) {
+	if s.isSealed() {
+		return s.readEntry(pos)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readEntry(pos)
+}
+
+// seal flushes the buffer and marks the store as sealed, after which it is read without taking the lock.
+func (s *store) seal() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	// Flush the buffer to ensure all data has been flushed into the file.
 	if err := s.buf.Flush(); err != nil {
-		return nil, err
+		return err
 	}
-	// Get the record size, represented in big endian encoding.
-	size := make([]byte, recordLenNumBytes)
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
-		return nil, err
+	atomic.StoreUint32(&s.sealed, 1)
+	return nil
+}
+
+// unseal marks the store as appendable again, e.g. when its segment becomes the active segment after a rollback.
+func (s *store) unseal() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	atomic.StoreUint32(&s.sealed, 0)
+}
+
+func (s *store) isSealed() bool {
+	return atomic.LoadUint32(&s.sealed) != 0
+}
+
+// Truncate flushes the buffer and discards every byte of the store from `size` onwards.
+func (s *store) Truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
 	}
-	// Make a byte slice of the correct size to hold the record data.
-	b := make([]byte, enc.Uint64(size))
-	if _, err := s.File.ReadAt(b, int64(pos+recordLenNumBytes)); err != nil {
-		return nil, err
+	if err := s.File.Truncate(int64(s.headerSize + size)); err != nil {
+		return err
+	}
+	s.size = size
+	return nil
+}
+
+// readEntry returns the record data of the entry at the specified position,
+// the entry's length in bytes and its attributes.
+// The caller must hold the lock, unless the store is sealed.
+func (s *store) readEntry(pos uint64) ([]byte, uint64, byte, error) {
+	b, n, attrs, err := s.readRawEntry(pos)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if b, err = decodeEntryData(b, attrs, s.keyring); err != nil {
+		return nil, 0, 0, err
+	}
+	return b, n, attrs, nil
+}
+
+// decodeEntryData decrypts and decompresses the record data of an entry with the specified attributes.
+func decodeEntryData(b []byte, attrs byte, keyring *Keyring) ([]byte, error) {
+	var err error
+	// The key not being in the keyring is not corruption, and must not get the entry truncated during recovery.
+	if attrs&attrEncrypted != 0 {
+		if keyring == nil {
+			return nil, errKeyNotFound
+		}
+		if b, err = keyring.decrypt(b); err != nil {
+			return nil, err
+		}
+	}
+	if codec := Compression(attrs & attrCompression); codec != CompressionNone {
+		if b, err = codec.decompress(b); err != nil {
+			return nil, errCorruptEntry
+		}
 	}
 	return b, nil
 }
 
+// readRawEntry verifies the entry at the specified position and returns its record data as it is in the store,
+// i.e. possibly compressed and encrypted, the entry's length in bytes and its attributes.
+// The caller must hold the lock, unless the store is sealed.
+func (s *store) readRawEntry(pos uint64) ([]byte, uint64, byte, error) {
+	if pos >= s.size {
+		return nil, 0, 0, io.EOF
+	}
+	// A partially written length prefix.
+	if pos+recordLenNumBytes > s.size {
+		return nil, 0, 0, errCorruptEntry
+	}
+	// Get the record attributes and size, represented in big endian encoding.
+	lenBytes := make([]byte, recordLenNumBytes)
+	if err := s.readAt(lenBytes, pos); err != nil {
+		return nil, 0, 0, err
+	}
+	attrs, size, headerLen, err := parseEntryHeader(lenBytes, s.legacy)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	dataPos := pos + headerLen
+	var sum []byte
+	if attrs&attrChecksum != 0 {
+		sum = make([]byte, checksumNumBytes)
+	}
+	// A partially written entry, or a corrupted length pointing past the end of the store.
+	if dataPos+size > s.size {
+		return nil, 0, 0, errCorruptEntry
+	}
+	if sum != nil {
+		if err := s.readAt(sum, pos+recordLenNumBytes); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	// Make a byte slice of the correct size to hold the record data.
+	b := make([]byte, size)
+	if err := s.readAt(b, dataPos); err != nil {
+		return nil, 0, 0, err
+	}
+	if sum != nil && enc.Uint32(sum) != checksum(lenBytes, b) {
+		return nil, 0, 0, errCorruptEntry
+	}
+	return b, dataPos + size - pos, attrs, nil
+}
+
+// parseEntryHeader returns the attributes and the record data length held by an entry's length prefix,
+// and the number of bytes before the entry's record data, i.e. of the length prefix and the checksum if any.
+// Entries without attributes, which predate checksums, are only allowed if `legacy` is true.
+func parseEntryHeader(lenBytes []byte, legacy bool) (attrs byte, size, headerLen uint64, err error) {
+	attrs = byte(enc.Uint64(lenBytes) >> entryAttrShift)
+	size = enc.Uint64(lenBytes) & entryLenMask
+	if attrs == 0 && !legacy {
+		return 0, 0, 0, errCorruptEntry
+	}
+	// Entries with attributes always have a checksum.
+	if attrs != 0 && (attrs&attrChecksum == 0 || attrs&^knownAttrs != 0 ||
+		Compression(attrs&attrCompression) > CompressionZstd) {
+		return 0, 0, 0, errCorruptEntry
+	}
+	headerLen = recordLenNumBytes
+	if attrs&attrChecksum != 0 {
+		headerLen += checksumNumBytes
+	}
+	return attrs, size, headerLen, nil
+}
+
+// EntryLen returns the length in bytes of the entry at the specified position, read from its length prefix.
+// The entry's record data is neither read nor verified.
+// It returns io.EOF if pos is at or past the end of the store,
+// and errCorruptEntry if the length prefix is invalid or points past the end of the store.
+func (s *store) EntryLen(pos uint64) (uint64, error) {
+	if !s.isSealed() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	if pos >= s.size {
+		return 0, io.EOF
+	}
+	if pos+recordLenNumBytes > s.size {
+		return 0, errCorruptEntry
+	}
+	lenBytes := make([]byte, recordLenNumBytes)
+	if err := s.readAt(lenBytes, pos); err != nil {
+		return 0, err
+	}
+	_, size, headerLen, err := parseEntryHeader(lenBytes, s.legacy)
+	if err != nil {
+		return 0, err
+	}
+	if pos+headerLen+size > s.size {
+		return 0, errCorruptEntry
+	}
+	return headerLen + size, nil
+}
+
+// readAt reads len(p) bytes of the store from `pos`, which must be within the store's size.
+// The bytes which are not written to the file yet are read from the buffer.
+// The caller must hold the lock, unless the store is sealed.
+func (s *store) readAt(p []byte, pos uint64) error {
+	flushed := s.size - uint64(s.buf.Buffered())
+	n := uint64(0)
+	if pos < flushed {
+		n = uint64(len(p))
+		if n > flushed-pos {
+			n = flushed - pos
+		}
+		if _, err := s.File.ReadAt(p[:n], int64(s.headerSize+pos)); err != nil {
+			return err
+		}
+	}
+	if n < uint64(len(p)) {
+		copy(p[n:], s.buf.Bytes()[pos+n-flushed:])
+	}
+	return nil
+}
+
 // ReadAt reads the record data for the given pos into `p`.
+// The file header is not part of the data, so the first entry is at pos 0.
 func (s *store) ReadAt(p []byte, pos int64) (int, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if err := s.buf.Flush(); err != nil {
+	if !s.isSealed() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	if pos < 0 || uint64(pos) >= s.size {
+		return 0, io.EOF
+	}
+	if rest := s.size - uint64(pos); uint64(len(p)) > rest {
+		if err := s.readAt(p[:rest], uint64(pos)); err != nil {
+			return 0, err
+		}
+		return int(rest), io.EOF
+	}
+	if err := s.readAt(p, uint64(pos)); err != nil {
 		return 0, err
 	}
-	return s.File.ReadAt(p, pos)
+	return len(p), nil
+}
+
+// Sync flushes the buffer and commits the file's contents to disk.
+func (s *store) Sync() error {
+	s.mu.Lock()
+	err := s.buf.Flush()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// The written entries are synced without the lock, so that reads and appends do not wait for the disk.
+	return s.File.Sync()
 }
 
 // Close flushes the buffer and closes the file.
@@ -97,3 +460,32 @@ func (s *store) Close() error {
 	}
 	return s.File.Close()
 }
+
+// EncryptedWithOtherKey reports whether any entry in the store is not encrypted with the keyring's active key.
+func (s *store) EncryptedWithOtherKey() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for pos := uint64(0); pos < s.size; {
+		b, n, attrs, err := s.readRawEntry(pos)
+		if err != nil {
+			return false, err
+		}
+		if attrs&attrEncrypted == 0 || s.keyring == nil {
+			return true, nil
+		}
+		id, err := entryKeyID(b)
+		if err != nil {
+			return false, err
+		}
+		if id != s.keyring.active {
+			return true, nil
+		}
+		pos += n
+	}
+	return false, nil
+}
+
+// checksum returns the CRC32 checksum of an entry's length prefix and record data.
+func checksum(lenBytes, p []byte) uint32 {
+	return crc32.Update(crc32.Checksum(lenBytes, crcTable), crcTable, p)
+}
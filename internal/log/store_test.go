@@ -1,6 +1,7 @@
 package log
 
 import (
+	"io"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -10,7 +11,7 @@ import (
 
 var (
 	recordData = []byte("hello world")
-	recordLen  = uint64(len(recordData)) + recordLenNumBytes
+	recordLen  = uint64(len(recordData)) + entryHeaderNumBytes
 )
 
 func TestStoreAppendRead(t *testing.T) {
@@ -24,6 +25,8 @@ func TestStoreAppendRead(t *testing.T) {
 	testAppend(t, s)
 	testRead(t, s)
 	testReadAt(t, s)
+	// Reads do not flush the buffer, so the entries are written to the file before the store is opened again.
+	require.NoError(t, s.Sync())
 
 	s, err = newStore(f)
 	require.NoError(t, err)
@@ -55,15 +58,16 @@ func testReadAt(t *testing.T, s *store) {
 	t.Helper()
 	var pos int64
 	for i := uint64(1); i < 4; i++ {
-		b := make([]byte, recordLenNumBytes)
-		// Read recordLen/size into `b`.
+		b := make([]byte, entryHeaderNumBytes)
+		// Read recordLen/size and the checksum into `b`.
 		nn, err := s.ReadAt(b, pos)
 		require.NoError(t, err)
-		require.Equal(t, recordLenNumBytes, nn)
+		require.Equal(t, entryHeaderNumBytes, nn)
 		pos += int64(nn)
 
-		// Get the size of the record.
-		size := enc.Uint64(b)
+		// Get the attributes and size of the record.
+		require.Equal(t, attrChecksum, byte(enc.Uint64(b)>>entryAttrShift))
+		size := enc.Uint64(b) & entryLenMask
 		// Read record data into `b`.
 		b = make([]byte, size)
 		nn, err = s.ReadAt(b, pos)
@@ -74,6 +78,103 @@ func testReadAt(t *testing.T, s *store) {
 	}
 }
 
+func TestStoreAppendBatch(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_append_batch_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	n, pos, err := s.AppendBatch([][]byte{recordData, recordData, recordData}, false)
+	require.NoError(t, err)
+	require.Equal(t, 3*recordLen, n)
+	require.Equal(t, []uint64{0, recordLen, 2 * recordLen}, pos)
+
+	// Every entry but the last is marked as continuing the batch.
+	for i, want := range []byte{attrChecksum | attrBatchCont, attrChecksum | attrBatchCont, attrChecksum} {
+		_, entryLen, attrs, err := s.Entry(pos[i])
+		require.NoError(t, err)
+		require.Equal(t, recordLen, entryLen)
+		require.Equal(t, want, attrs)
+		read, err := s.Read(pos[i])
+		require.NoError(t, err)
+		require.Equal(t, recordData, read)
+	}
+}
+
+func TestStoreChecksum(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_checksum_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	_, pos, err := s.Append(recordData)
+	require.NoError(t, err)
+	_, err = s.Read(pos)
+	require.NoError(t, err)
+	require.NoError(t, s.Sync())
+
+	// Flip a byte of the record data.
+	_, err = f.WriteAt([]byte{'j'}, int64(pos+entryHeaderNumBytes))
+	require.NoError(t, err)
+	_, err = s.Read(pos)
+	require.Equal(t, errCorruptEntry, err)
+}
+
+func TestStoreReadLegacy(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_read_legacy_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	// Entries written before checksums were introduced only hold the length and the record data.
+	b := make([]byte, recordLenNumBytes)
+	enc.PutUint64(b, uint64(len(recordData)))
+	_, err = f.Write(append(b, recordData...))
+	require.NoError(t, err)
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	read, err := s.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, recordData, read)
+
+	// New entries are appended with checksums after the legacy entries.
+	_, pos, err := s.Append(recordData)
+	require.NoError(t, err)
+	require.Equal(t, uint64(recordLenNumBytes+len(recordData)), pos)
+	read, err = s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, recordData, read)
+}
+
+func TestStoreChecksumAttrCleared(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_checksum_attr_cleared_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(encodeFileHeader(storeMagic, 0, 0))
+	require.NoError(t, err)
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	require.False(t, s.legacy)
+	_, pos, err := s.Append(recordData)
+	require.NoError(t, err)
+	require.NoError(t, s.Sync())
+
+	// Clearing the checksum attribute makes the entry look like a legacy entry, which the store cannot hold.
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, int64(s.headerSize+pos))
+	require.NoError(t, err)
+	require.Equal(t, attrChecksum, b[0])
+	_, err = f.WriteAt([]byte{b[0] &^ attrChecksum}, int64(s.headerSize+pos))
+	require.NoError(t, err)
+	_, err = s.Read(pos)
+	require.Equal(t, errCorruptEntry, err)
+	_, err = s.EntryLen(pos)
+	require.Equal(t, errCorruptEntry, err)
+}
+
 func TestStoreClose(t *testing.T) {
 	f, err := ioutil.TempFile("", "store_close_test")
 	require.NoError(t, err)
@@ -96,6 +197,80 @@ func TestStoreClose(t *testing.T) {
 	require.Equal(t, int64(recordLen), afterSize)
 }
 
+func TestStoreReadBuffered(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_read_buffered_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	// The entries do not fit into the buffer, so the earlier entries are written to the file.
+	var positions []uint64
+	for i := 0; i < 2*tailBufferSize/int(recordLen); i++ {
+		_, pos, err := s.Append(recordData)
+		require.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	_, fileSize, err := openFile(f.Name())
+	require.NoError(t, err)
+	require.Greater(t, fileSize, int64(0))
+	require.Less(t, fileSize, int64(s.size))
+
+	// Every entry is read, and reading the buffered entries does not write them to the file.
+	for _, pos := range positions {
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, recordData, read)
+	}
+	b := make([]byte, s.size+1)
+	n, err := s.ReadAt(b, 0)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, int(s.size), n)
+	_, size, err := openFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, fileSize, size)
+
+	// The bytes read from the buffer are the bytes written to the file.
+	require.NoError(t, s.Sync())
+	onDisk, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, onDisk, b[:n])
+}
+
+func TestStoreSeal(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_seal_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	_, pos, err := s.Append(recordData)
+	require.NoError(t, err)
+
+	// Sealing flushes the buffer, so the entry is read without the lock.
+	require.NoError(t, s.seal())
+	s.mu.Lock()
+	read, err := s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, recordData, read)
+	b := make([]byte, recordLen)
+	_, err = s.ReadAt(b, int64(pos))
+	require.NoError(t, err)
+	s.mu.Unlock()
+
+	_, _, err = s.Append(recordData)
+	require.Equal(t, errStoreSealed, err)
+	_, _, err = s.AppendBatch([][]byte{recordData}, false)
+	require.Equal(t, errStoreSealed, err)
+
+	s.unseal()
+	_, pos, err = s.Append(recordData)
+	require.NoError(t, err)
+	read, err = s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, recordData, read)
+}
+
 func openFile(name string) (file *os.File, size int64, err error) {
 	f, err := os.OpenFile(
 		name,
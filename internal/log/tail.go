@@ -0,0 +1,55 @@
+package log
+
+import "io"
+
+// tailBufferSize is the number of bytes of entries a store buffers before writing them to its file.
+const tailBufferSize = 4096
+
+// tailBuffer buffers the latest entries appended to a store until they are written to the store's file.
+// Unlike a bufio.Writer, it gives access to the buffered bytes, so that the latest entries can be read
+// without writing them to the file first.
+type tailBuffer struct {
+	w io.Writer
+	b []byte
+}
+
+func newTailBuffer(w io.Writer) *tailBuffer {
+	return &tailBuffer{w: w, b: make([]byte, 0, tailBufferSize)}
+}
+
+// Write buffers p, first writing the buffered bytes to the file if p does not fit.
+// A p larger than the buffer is written to the file directly.
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	if len(t.b)+len(p) > cap(t.b) {
+		if err := t.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	if len(p) > cap(t.b) {
+		return t.w.Write(p)
+	}
+	t.b = append(t.b, p...)
+	return len(p), nil
+}
+
+// Flush writes the buffered bytes to the file.
+// If the write fails, the bytes which were not written stay buffered.
+func (t *tailBuffer) Flush() error {
+	if len(t.b) == 0 {
+		return nil
+	}
+	n, err := t.w.Write(t.b)
+	t.b = t.b[:copy(t.b, t.b[n:])]
+	return err
+}
+
+// Buffered returns the number of bytes which are not written to the file yet.
+func (t *tailBuffer) Buffered() int {
+	return len(t.b)
+}
+
+// Bytes returns the bytes which are not written to the file yet.
+// They are only valid until the next call to Write or Flush.
+func (t *tailBuffer) Bytes() []byte {
+	return t.b
+}
@@ -0,0 +1,146 @@
+package log
+
+import (
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	api "github.com/jxofficial/log/api/v1"
+)
+
+// indexTime adds an entry to the time index if the record is later than every record before it in the segment,
+// and at least `Segment.TimeIndexIntervalBytes` were appended to the store since the last entry.
+// Records without a timestamp are not indexed.
+func (s *segment) indexTime(record *api.Record, pos uint64) error {
+	ts := record.GetTimestamp().AsTime().UnixNano()
+	if record.Timestamp == nil || ts <= s.maxTimestamp {
+		return nil
+	}
+	s.maxTimestamp, s.maxTimestampOffset = ts, record.Offset
+	if pos < s.timeIndexPos+s.config.Segment.TimeIndexIntervalBytes {
+		return nil
+	}
+	// A full time index only means that lookups scan more records.
+	if err := s.timeIndex.Write(uint32(record.Offset-s.baseOffset), uint64(ts)); err != nil && err != io.EOF {
+		return err
+	}
+	s.timeIndexPos = pos
+	return nil
+}
+
+// sealTimeIndex adds an entry for the segment's latest record to the time index,
+// so that the segment's latest timestamp is known without scanning its records when it is opened again.
+func (s *segment) sealTimeIndex() error {
+	if _, ts, err := s.timeIndex.Read(-1); err == nil && int64(ts) >= s.maxTimestamp {
+		return nil
+	}
+	if s.maxTimestamp == 0 {
+		return nil
+	}
+	// If the time index is full, the records after its last entry are scanned when the segment is opened.
+	if err := s.timeIndex.Write(uint32(s.maxTimestampOffset-s.baseOffset), uint64(s.maxTimestamp)); err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// loadTimeIndex discards the time index entries of records which are no longer in the segment,
+// and indexes the records after the last entry, e.g. if the process crashed before the segment was closed,
+// or the segment was written before time indexes were introduced.
+func (s *segment) loadTimeIndex() error {
+	n, _ := s.timeIndex.Entries()
+	for n > 0 {
+		off, _, err := s.timeIndex.Read(int64(n - 1))
+		if err != nil {
+			return err
+		}
+		if s.baseOffset+uint64(off) < s.nextOffset {
+			break
+		}
+		n--
+	}
+	s.timeIndex.Truncate(n)
+
+	s.maxTimestamp, s.maxTimestampOffset, s.timeIndexPos = 0, 0, 0
+	start := s.baseOffset
+	if n > 0 {
+		off, ts, err := s.timeIndex.Read(int64(n - 1))
+		if err != nil {
+			return err
+		}
+		s.maxTimestamp, s.maxTimestampOffset = int64(ts), s.baseOffset+uint64(off)
+		start = s.maxTimestampOffset
+	}
+	return s.scan(start, func(record *api.Record, pos uint64) (bool, error) {
+		// A corrupt record is reported when it is read, and does not stop the segment from opening.
+		if record == nil {
+			return true, nil
+		}
+		if n > 0 && record.Offset == s.maxTimestampOffset {
+			s.timeIndexPos = pos
+		}
+		return true, s.indexTime(record, pos)
+	})
+}
+
+// OffsetForTime returns the offset of the first record in the segment
+// with a timestamp at or after `ts`, in unix nanoseconds.
+// It returns false if no record in the segment is that late.
+func (s *segment) OffsetForTime(ts int64) (uint64, bool, error) {
+	if s.maxTimestamp < ts {
+		return 0, false, nil
+	}
+	// An entry's record is the latest of every record up to it,
+	// so the scan starts after the last entry which is earlier than `ts`.
+	n := int(s.timeIndex.size / indexLenNumBytes)
+	j := sort.Search(n, func(j int) bool {
+		_, entryTs, _ := s.timeIndex.Read(int64(j))
+		return int64(entryTs) >= ts
+	})
+	start := s.baseOffset
+	if j > 0 {
+		off, _, err := s.timeIndex.Read(int64(j - 1))
+		if err != nil {
+			return 0, false, err
+		}
+		start = s.baseOffset + uint64(off) + 1
+	}
+	var found uint64
+	var ok bool
+	err := s.scan(start, func(record *api.Record, _ uint64) (bool, error) {
+		if record == nil || record.GetTimestamp().AsTime().UnixNano() < ts {
+			return true, nil
+		}
+		found, ok = record.Offset, true
+		return false, nil
+	})
+	return found, ok, err
+}
+
+// OffsetForTime returns the offset of the first record with a timestamp at or after `t`.
+// Records without a timestamp are treated as being from the Unix epoch.
+// If no record is that late, it returns the offset the next appended record will get.
+func (l *Log) OffsetForTime(t time.Time) (uint64, error) {
+	var ts int64
+	switch {
+	case t.Before(time.Unix(0, 0)):
+		ts = 0
+	case t.After(time.Unix(0, math.MaxInt64)):
+		ts = math.MaxInt64
+	default:
+		ts = t.UnixNano()
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, s := range l.segments {
+		off, ok, err := s.OffsetForTime(ts)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return off, nil
+		}
+	}
+	return l.activeSegment.nextOffset, nil
+}
@@ -0,0 +1,114 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/jxofficial/log/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var timeIndexStart = time.Unix(1600000000, 0)
+
+func TestSegmentTimeIndex(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment_time_index_test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.TimeIndexIntervalBytes = 100
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	// The record at offset 21 is produced late, with an earlier timestamp than the records before it.
+	for _, sec := range []int64{0, 1, 2, 3, 4, 2, 6, 7, 8, 9} {
+		appendRecord(t, s, &api.Record{
+			Value:     []byte("hello world"),
+			Timestamp: timestamppb.New(timeIndexStart.Add(time.Duration(sec) * time.Second)),
+		})
+	}
+	// The index is sparse: only some of the records have entries.
+	n, _ := s.timeIndex.Entries()
+	require.Greater(t, n, uint64(0))
+	require.Less(t, n, uint64(10))
+
+	requireOffsetsForTime := func(s *segment) {
+		t.Helper()
+		for sec, want := range map[int64]uint64{-1: 16, 0: 16, 2: 18, 5: 22, 9: 25} {
+			off, ok, err := s.OffsetForTime(timeIndexStart.Add(time.Duration(sec) * time.Second).UnixNano())
+			require.NoError(t, err)
+			require.True(t, ok, "second %d", sec)
+			require.Equal(t, want, off, "second %d", sec)
+		}
+		_, ok, err := s.OffsetForTime(timeIndexStart.Add(10 * time.Second).UnixNano())
+		require.NoError(t, err)
+		require.False(t, ok)
+	}
+	requireOffsetsForTime(s)
+
+	// The segment's latest timestamp is indexed when the segment is closed.
+	require.NoError(t, s.Close())
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	_, ts, err := s.timeIndex.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(timeIndexStart.Add(9*time.Second).UnixNano()), ts)
+	requireOffsetsForTime(s)
+
+	// A missing time index is rebuilt from the store.
+	require.NoError(t, s.Close())
+	require.NoError(t, os.Remove(s.timeIndex.Name()))
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	requireOffsetsForTime(s)
+	require.NoError(t, s.Remove())
+}
+
+func TestLogOffsetForTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log_offset_for_time_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	// Each segment holds three records.
+	c.Segment.MaxIndexBytes = 3 * indexLenNumBytes
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 8; i++ {
+		_, err := log.Append(&api.Record{
+			Value:     []byte("hello world"),
+			Timestamp: timestamppb.New(timeIndexStart.Add(time.Duration(i) * time.Minute)),
+		})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 3)
+
+	for at, want := range map[time.Time]uint64{
+		{}:                                  0,
+		timeIndexStart:                      0,
+		timeIndexStart.Add(time.Second):     1,
+		timeIndexStart.Add(4 * time.Minute): 4,
+		timeIndexStart.Add(7 * time.Minute): 7,
+		timeIndexStart.Add(time.Hour):       8,
+		time.Unix(1<<40, 0):                 8,
+		timeIndexStart.Add(-24 * time.Hour): 0,
+	} {
+		off, err := log.OffsetForTime(at)
+		require.NoError(t, err)
+		require.Equal(t, want, off, "time %v", at)
+	}
+
+	// Records without a timestamp are stamped when they are appended.
+	before := time.Now()
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	found, err := log.OffsetForTime(before)
+	require.NoError(t, err)
+	require.Equal(t, off, found)
+}
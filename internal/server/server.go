@@ -2,9 +2,12 @@ package server
 
 import (
 	"context"
+	"time"
 
 	api "github.com/jxofficial/log/api/v1"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type Config struct {
@@ -44,6 +47,21 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (
 	return &api.ProduceResponse{Offset: offset}, nil
 }
 
+func (s *grpcServer) ProduceBatch(ctx context.Context, req *api.ProduceBatchRequest) (
+	*api.ProduceBatchResponse,
+	error,
+) {
+	// An empty batch has no first offset to return.
+	if len(req.Records) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "produce batch: no records")
+	}
+	offset, err := s.CommitLog.AppendBatch(req.Records)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ProduceBatchResponse{FirstOffset: offset}, nil
+}
+
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (
 	*api.ConsumeResponse,
 	error,
@@ -55,6 +73,26 @@ func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (
 	return &api.ConsumeResponse{Record: record}, nil
 }
 
+// defaultRawMaxBytes is the size of the entries ConsumeRaw returns if the request does not limit it.
+const defaultRawMaxBytes = 1 << 20
+
+// ConsumeRaw returns the log's store entries from the req's offset onwards as they are in the log,
+// so that followers catching up copy them without each record being decoded and encoded again.
+func (s *grpcServer) ConsumeRaw(ctx context.Context, req *api.ConsumeRawRequest) (
+	*api.ConsumeRawResponse,
+	error,
+) {
+	maxBytes := req.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = defaultRawMaxBytes
+	}
+	entries, next, err := s.CommitLog.ReadRaw(req.Offset, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ConsumeRawResponse{Entries: entries, NextOffset: next}, nil
+}
+
 func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 	for {
 		req, err := stream.Recv()
@@ -71,12 +109,20 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 	}
 }
 
-// ConsumeStream streams all logs starting from the req's offset.
+// ConsumeStream streams all logs starting from the req's offset,
+// or from the first record at or after the req's start time if it is set.
 // The stream is able to stream future logs.
 func (s *grpcServer) ConsumeStream(
 	req *api.ConsumeRequest,
 	stream api.Log_ConsumeStreamServer,
 ) error {
+	if req.StartTime != nil {
+		offset, err := s.CommitLog.OffsetForTime(req.StartTime.AsTime())
+		if err != nil {
+			return err
+		}
+		req.Offset = offset
+	}
 	for {
 		select {
 		case <-stream.Context().Done():
@@ -88,6 +134,10 @@ func (s *grpcServer) ConsumeStream(
 			// Stream continues waiting for future logs.
 			case api.ErrOffsetOutOfRange:
 				continue
+			case api.ErrOffsetCompacted:
+				// Skip the gap left by compaction.
+				req.Offset++
+				continue
 			default:
 				return err
 			}
@@ -101,5 +151,8 @@ func (s *grpcServer) ConsumeStream(
 
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
+	AppendBatch([]*api.Record) (uint64, error)
 	Read(uint64) (*api.Record, error)
+	ReadRaw(from, maxBytes uint64) ([]byte, uint64, error)
+	OffsetForTime(time.Time) (uint64, error)
 }
@@ -2,13 +2,20 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"github.com/golang/protobuf/proto"
 	"github.com/jxofficial/log/internal/config"
 	"github.com/jxofficial/log/internal/log"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"io/ioutil"
 	"net"
+	"os"
+	"path"
 	"testing"
+	"time"
 
 	api "github.com/jxofficial/log/api/v1"
 	"github.com/stretchr/testify/require"
@@ -25,6 +32,11 @@ func TestServer(t *testing.T) {
 		"produce/consume a message to/from the log succeeds": testProduceConsume,
 		"consume past boundary fails":                        testConsumePastBoundary,
 		"produce/consume stream works":                       testProduceConsumeStream,
+		"consume corrupt record fails":                       testConsumeCorruptRecord,
+		"produce batch/consume the batch's records succeeds": testProduceBatchConsume,
+		"consume stream skips compacted records":             testConsumeStreamCompacted,
+		"consume stream from a start time":                   testConsumeStreamFromTime,
+		"consume raw entries of the log's records":           testConsumeRaw,
 	}
 
 	for scenario, fn := range tests {
@@ -124,6 +136,8 @@ func testProduceConsume(t *testing.T, client, _ api.LogClient, cfg *Config) {
 	require.NoError(t, err)
 	require.Equal(t, r.Value, consume.Record.Value)
 	require.Equal(t, r.Offset, consume.Record.Offset)
+	// The broker stamps the record with the time it was appended.
+	require.WithinDuration(t, time.Now(), consume.Record.Timestamp.AsTime(), time.Minute)
 }
 
 func testConsumePastBoundary(t *testing.T, client, _ api.LogClient, cfg *Config) {
@@ -152,12 +166,16 @@ func testProduceConsumeStream(
 	ctx := context.Background()
 	rr := []*api.Record{
 		{
-			Value:  []byte("first message"),
-			Offset: 0,
+			Value:     []byte("first message"),
+			Offset:    0,
+			Key:       []byte("first key"),
+			Headers:   []*api.Header{{Key: "trace-id", Value: []byte("abc")}},
+			Timestamp: timestamppb.New(time.Unix(1600000000, 0)),
 		},
 		{
-			Value:  []byte("second message"),
-			Offset: 1,
+			Value:     []byte("second message"),
+			Offset:    1,
+			Timestamp: timestamppb.New(time.Unix(1600000001, 0)),
 		},
 	}
 
@@ -184,10 +202,159 @@ func testProduceConsumeStream(
 		for i, r := range rr {
 			resp, err := stream.Recv()
 			require.NoError(t, err)
-			require.Equal(t, resp.Record, &api.Record{
-				Value:  r.Value,
-				Offset: uint64(i),
-			})
+			require.True(t, proto.Equal(resp.Record, &api.Record{
+				Value:     r.Value,
+				Offset:    uint64(i),
+				Key:       r.Key,
+				Headers:   r.Headers,
+				Timestamp: r.Timestamp,
+			}), "got record: %v", resp.Record)
 		}
 	}
 }
+
+func testConsumeCorruptRecord(t *testing.T, client, _ api.LogClient, cfg *Config) {
+	ctx := context.Background()
+	r := &api.Record{Value: []byte("hello world")}
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{Record: r})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	// Consuming the record does not flush it, so it is written to the store file first.
+	require.NoError(t, cfg.CommitLog.(*log.Log).Sync())
+
+	// Flip the last byte of the record in the store file.
+	f, err := os.OpenFile(
+		path.Join(cfg.CommitLog.(*log.Log).Dir, "0.store"),
+		os.O_RDWR,
+		0644,
+	)
+	require.NoError(t, err)
+	defer f.Close()
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, fi.Size()-1)
+	require.NoError(t, err)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.Nil(t, consume)
+	got := status.Code(err)
+	want := status.Code(api.ErrCorruptRecord{}.GRPCStatus().Err())
+	require.Equal(t, want, got)
+}
+
+func testProduceBatchConsume(t *testing.T, client, _ api.LogClient, cfg *Config) {
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("first message")}})
+	require.NoError(t, err)
+
+	rr := []*api.Record{
+		{Value: []byte("second message")},
+		{Value: []byte("third message")},
+	}
+	produce, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: rr})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), produce.FirstOffset)
+
+	for i, r := range rr {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.FirstOffset + uint64(i)})
+		require.NoError(t, err)
+		require.Equal(t, r.Value, consume.Record.Value)
+		require.Equal(t, produce.FirstOffset+uint64(i), consume.Record.Offset)
+	}
+
+	// An empty batch is refused, and does not take the next record's offset.
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	next, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("fourth message")}})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), next.Offset)
+}
+
+func testConsumeStreamCompacted(t *testing.T, client, _ api.LogClient, cfg *Config) {
+	ctx := context.Background()
+	records := []*api.Record{{Value: []byte("first message")}}
+	// Enough records with the same key for the log to roll over to a new segment.
+	for i := 0; i < 50; i++ {
+		records = append(records, &api.Record{Key: []byte("key"), Value: []byte(fmt.Sprintf("value %d", i))})
+	}
+	records = append(records, &api.Record{Value: []byte("last message")})
+	produce, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: records})
+	require.NoError(t, err)
+	require.NoError(t, cfg.CommitLog.(*log.Log).Compact())
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: produce.FirstOffset + 1})
+	require.Equal(t, status.Code(api.ErrOffsetCompacted{}.GRPCStatus().Err()), status.Code(err))
+
+	// The stream skips the compacted records of the sealed segment,
+	// and continues with the records of the active segment.
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: produce.FirstOffset})
+	require.NoError(t, err)
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "first message", string(resp.Record.Value))
+	resp, err = stream.Recv()
+	require.NoError(t, err)
+	require.Greater(t, resp.Record.Offset, produce.FirstOffset+1)
+	require.Equal(t, []byte("key"), resp.Record.Key)
+}
+
+func testConsumeStreamFromTime(t *testing.T, client, _ api.LogClient, cfg *Config) {
+	ctx := context.Background()
+	start := time.Unix(1600000000, 0)
+	var rr []*api.Record
+	for i := 0; i < 3; i++ {
+		rr = append(rr, &api.Record{
+			Value:     []byte(fmt.Sprintf("message %d", i)),
+			Timestamp: timestamppb.New(start.Add(time.Duration(i) * time.Hour)),
+		})
+	}
+	_, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: rr})
+	require.NoError(t, err)
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		StartTime: timestamppb.New(start.Add(30 * time.Minute)),
+	})
+	require.NoError(t, err)
+	for i, r := range rr[1:] {
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i+1), resp.Record.Offset)
+		require.Equal(t, r.Value, resp.Record.Value)
+	}
+}
+
+func testConsumeRaw(t *testing.T, client, _ api.LogClient, cfg *Config) {
+	ctx := context.Background()
+	var records []*api.Record
+	for i := 0; i < 5; i++ {
+		records = append(records, &api.Record{Value: []byte(fmt.Sprintf("message %d", i))})
+	}
+	produce, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: records})
+	require.NoError(t, err)
+
+	// The entries are read in chunks until every record has been read.
+	var read []*api.Record
+	offset := produce.FirstOffset
+	for {
+		resp, err := client.ConsumeRaw(ctx, &api.ConsumeRawRequest{Offset: offset, MaxBytes: 64})
+		require.NoError(t, err)
+		if len(resp.Entries) == 0 {
+			require.Equal(t, offset, resp.NextOffset)
+			break
+		}
+		decoded, err := log.DecodeRaw(resp.Entries, nil)
+		require.NoError(t, err)
+		read = append(read, decoded...)
+		offset = resp.NextOffset
+	}
+	require.Len(t, read, len(records))
+	for i, record := range read {
+		require.Equal(t, produce.FirstOffset+uint64(i), record.Offset)
+		require.Equal(t, records[i].Value, record.Value)
+	}
+
+	_, err = client.ConsumeRaw(ctx, &api.ConsumeRawRequest{Offset: offset + 1})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+}